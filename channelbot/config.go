@@ -13,29 +13,47 @@ const (
 	DefaultParseMode               = tele.ModeMarkdownV2
 	DefaultStartMessage            = "Hmm?.."
 	DefaultDefaultPostText         = ""
+	DefaultSourceFormat            = "via [{title}]({link})"
+	DefaultSourcePlacement         = SourcePlacementCaption
+	DefaultCommentTimeout          = 600
+	DefaultMaxPublishFailures      = 3
 )
 
 type Config struct {
-	Token            string   `json:"token"`
-	AdminList        []int64  `json:"admin-list"`
-	DefaultPostTimes []string `json:"default-post-times"`
-	ChannelId        int64    `json:"channel-id"`
-	CommentsId       int64    `json:"comments-id"`
-	StartMessage     string   `json:"start-message"`
+	Token            string              `json:"token"`
+	AdminList        []int64             `json:"admin-list"`
+	DefaultPostTimes []string            `json:"default-post-times"`
+	PostTimeTags     map[string][]string `json:"post-time-tags,omitempty"`
+	ChannelId        int64               `json:"channel-id"`
+	CommentsId       int64               `json:"comments-id"`
+	StartMessage     string              `json:"start-message"`
 
 	TemporaryFilesDirectory string `json:"temporary-files-directory,omitempty"`
+	TemporaryFilesQuota     int64  `json:"temporary-files-quota,omitempty"`
 	RedisPrefix             string `json:"redis-prefix,omitempty"`
 	RedisAddress            string `json:"redis-address,omitempty"`
 	RedisDatabaseNumber     int    `json:"redis-database-number,omitempty"`
 
 	DefaultPostText       string `json:"default-post-text,omitempty"`
+	SourceFormat          string `json:"source-format,omitempty"`
+	SourcePlacement       string `json:"source-placement,omitempty"`
 	DisableWebPagePreview bool   `json:"disable-web-page-preview,omitempty"`
 	DisableNotification   bool   `json:"disable-notification,omitempty"`
+	MediaSpoiler          bool   `json:"media-spoiler,omitempty"`
+	CommentTimeout        int    `json:"comment-timeout,omitempty"`      // seconds to wait for the forward to the comments chat
+	MaxPublishFailures    int    `json:"max-publish-failures,omitempty"` // then the post is quarantined
 	Verbose               bool   `json:"verbose,omitempty"`
 	Local                 bool   `json:"local,omitempty"`
 	Sync                  bool   `json:"sync,omitempty"`
 	Url                   string `json:"url,omitempty"`
 
+	Webhook    *WebhookConfig `json:"webhook,omitempty"` // long polling is used if it is not set
+	RateLimits RateLimits     `json:"rate-limits"`
+
+	Converter       Converter `json:"converter"`
+	MediaWorkers    int       `json:"media-workers,omitempty"`
+	MediaCacheQuota int64     `json:"media-cache-quota,omitempty"`
+
 	ConfigPath string `json:"config-path,omitempty"`
 }
 
@@ -55,6 +73,18 @@ func (cfg Config) FillDefaults() Config {
 	if cfg.StartMessage == "" {
 		cfg.StartMessage = DefaultStartMessage
 	}
+	if cfg.SourceFormat == "" {
+		cfg.SourceFormat = DefaultSourceFormat
+	}
+	if cfg.SourcePlacement == "" {
+		cfg.SourcePlacement = DefaultSourcePlacement
+	}
+	if cfg.CommentTimeout <= 0 {
+		cfg.CommentTimeout = DefaultCommentTimeout
+	}
+	if cfg.MaxPublishFailures <= 0 {
+		cfg.MaxPublishFailures = DefaultMaxPublishFailures
+	}
 	return cfg
 }
 
@@ -95,31 +125,79 @@ var ChannelBotCommands = []tele.Command{
 		Description: "post the post immediately",
 	}, {
 		Text:        "/random",
-		Description: "make a random post immediately",
+		Description: "[#tag] make a random post immediately",
 	}, {
 		Text:        "/remove",
 		Description: "delete the post from the database",
 	}, {
 		Text:        "/source",
 		Description: "post sources in the comments of the post",
+	}, {
+		Text:        "/comments",
+		Description: "list comments of the post (end a reply with .c to add a text comment)",
+	}, {
+		Text:        "/movecomment",
+		Description: "N M move the comment N to the position M",
+	}, {
+		Text:        "/delcomment",
+		Description: "[N] remove the comment",
+	}, {
+		Text:        "/nosource",
+		Description: "remove the attribution of a forwarded post",
 	}, {
 		Text:        "/notext",
 		Description: "clear text of the post",
 	}, {
 		Text:        "/nocomment",
-		Description: "remove the comment of the post",
+		Description: "remove all comments of the post",
 	}, {
 		Text:        "/nocommenttext",
-		Description: "clear text of a post's comment",
+		Description: "clear texts of post's comments",
 	}, {
 		Text:        "/docs",
-		Description: "convert docs to images in comments (or vice-versa)",
+		Description: "[N] convert docs to images in comments (or vice-versa)",
+	}, {
+		Text:        "/tag",
+		Description: "[#tag...] set tags of the post",
+	}, {
+		Text:        "/up",
+		Description: "[N] move the file up in the album (send media captioned /replace to replace the file)",
+	}, {
+		Text:        "/down",
+		Description: "[N] move the file down in the album",
+	}, {
+		Text:        "/drop",
+		Description: "[N] drop the file from the album",
+	}, {
+		Text:        "/merge",
+		Description: "reply to two posts in turn to merge the second one into the first",
+	}, {
+		Text:        "/split",
+		Description: "N cut the album into two posts after N files",
+	}, {
+		Text:        "/expire",
+		Description: "[36h|2d|YYYY-MM-DD HH:MM] delete the post from the channel later",
 	}, {
 		Text:        "/protected",
 		Description: "make post protected/unprotected",
+	}, {
+		Text:        "/spoiler",
+		Description: "hide post's photos and videos under a spoiler (or show them)",
+	}, {
+		Text:        "/nowatermark",
+		Description: "publish post's photos and videos without the watermark (or with it)",
+	}, {
+		Text:        "/silent",
+		Description: "post without a notification (or with it)",
+	}, {
+		Text:        "/nopreview",
+		Description: "disable link previews of a text post (or enable them)",
 	}, {
 		Text:        "/schedule",
-		Description: "[HH:MM...] change schedule",
+		Description: "[HH:MM[#tag...]...] change schedule",
+	}, {
+		Text:        "/failed",
+		Description: "[retry|edit|discard N] list posts quarantined after failed publishing",
 	}, {
 		Text:        "/clear",
 		Description: "[all] remove all post from DB",
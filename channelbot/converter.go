@@ -3,6 +3,7 @@ package channelbot
 import (
 	"errors"
 	"fmt"
+	"image/color"
 	"os"
 	"os/exec"
 	"strconv"
@@ -13,19 +14,63 @@ const (
 	DefaultConvertPath  = "convert"
 	DefaultIdentifyPath = "identify"
 	DefaultFfmpegPath   = "ffmpeg"
+	DefaultFfprobePath  = "ffprobe"
 	DefaultMaximumSizes = "3840x3840"
 	DefaultJpgQuality   = "93"
 	DefaultPreset       = "fast"
+	DefaultImageBackend = ImageBackendAuto
+	DefaultBackground   = "#ffffff"
+)
+
+const (
+	TelegramMaxPhotoSize       = 10_000_000
+	TelegramMaxPhotoDimensions = 10_000 // width + height
+)
+
+const (
+	ImageBackendAuto   = ""       // magick if its binaries are found, native otherwise
+	ImageBackendMagick = "magick" // ImageMagick's convert and identify
+	ImageBackendNative = "native" // pure go, png, jpeg, gif, webp, tiff and bmp only
 )
 
 type Converter struct {
-	ConvertPath  string
-	FfmpegPath   string
-	IdentifyPath string
+	ConvertPath  string `json:"convert-path,omitempty"`
+	FfmpegPath   string `json:"ffmpeg-path,omitempty"`
+	FfprobePath  string `json:"ffprobe-path,omitempty"`
+	IdentifyPath string `json:"identify-path,omitempty"`
+
+	MaximumSizes string `json:"maximum-sizes,omitempty"`
+	JpgQuality   string `json:"jpg-quality,omitempty"`
+	Preset       string `json:"preset,omitempty"`
+	ImageBackend string `json:"image-backend,omitempty"`
+	Background   string `json:"background,omitempty"` // transparent images are put on it, #rrggbb
+
+	Watermark Watermark `json:"watermark"`
+
+	images     ImageProcessor
+	background color.Color // parsed Background
+}
+
+// ToolStatus is a result of checking an external binary of the converter
+type ToolStatus struct {
+	Name    string
+	Path    string
+	Version string
+	Err     error
+}
+
+func (tool ToolStatus) String() string {
+	if tool.Err != nil {
+		return fmt.Sprintf("%s (%s): %s", tool.Name, tool.Path, tool.Err.Error())
+	}
+	return fmt.Sprintf("%s (%s): %s", tool.Name, tool.Path, tool.Version)
+}
 
-	MaximumSizes string
-	JpgQuality   string
-	Preset       string
+// ImageProcessor is an image backend of Converter
+type ImageProcessor interface {
+	IdentifyImage(filename string) (*ImageInfo, error)
+	// ConvertImage writes the image as jpeg without metadata, resized to fit the maximum sizes
+	ConvertImage(filename string, newFilename string, quality int) error
 }
 
 func NewConverter(args ...Converter) *Converter {
@@ -43,6 +88,9 @@ func NewConverter(args ...Converter) *Converter {
 	if converter.FfmpegPath == "" {
 		converter.FfmpegPath = DefaultFfmpegPath
 	}
+	if converter.FfprobePath == "" {
+		converter.FfprobePath = DefaultFfprobePath
+	}
 	if converter.Preset == "" {
 		converter.Preset = DefaultPreset
 	}
@@ -52,40 +100,101 @@ func NewConverter(args ...Converter) *Converter {
 	if converter.JpgQuality == "" {
 		converter.JpgQuality = DefaultJpgQuality
 	}
+	if converter.Background == "" {
+		converter.Background = DefaultBackground
+	}
 
-	return &converter
-}
+	converter.Watermark.fillDefaults()
 
-func (converter *Converter) IdentifyImage(filename string) (*ImageInfo, error) {
-	stat, err := os.Stat(filename)
+	background, err := parseHexColor(converter.Background)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("while identifying %s an error occured %s", filename, err.Error()))
+		converter.Background = DefaultBackground
+		background, _ = parseHexColor(DefaultBackground)
 	}
-	info := ImageInfo{Size: stat.Size()}
+	magick := &MagickImageProcessor{ConvertPath: converter.ConvertPath, IdentifyPath: converter.IdentifyPath,
+		MaximumSizes: converter.MaximumSizes, Background: converter.Background}
+	native := &NativeImageProcessor{MaximumSizes: converter.MaximumSizes, Background: background}
+	converter.background = background
 
-	output, err := exec.Command(converter.IdentifyPath, filename).Output()
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("while identifying %s an error occured %s\n%s", filename, err.Error(), string(output)))
+	switch converter.ImageBackend {
+	case ImageBackendMagick:
+		converter.images = magick
+	case ImageBackendNative:
+		converter.images = native
+	default:
+		_, convertErr := exec.LookPath(converter.ConvertPath)
+		_, identifyErr := exec.LookPath(converter.IdentifyPath)
+		if convertErr == nil && identifyErr == nil {
+			converter.ImageBackend = ImageBackendMagick
+			converter.images = magick
+		} else {
+			converter.ImageBackend = ImageBackendNative
+			converter.images = native
+		}
 	}
-	args := strings.Split(string(output), " ")
-	if len(args) < 3 {
-		return nil, errors.New(fmt.Sprintf("while identifying %s, weird info has gotten %s", filename, string(output)))
+
+	return &converter
+}
+
+// CheckTools looks for the binaries the converter is going to use, ImageMagick is checked only if it is the image backend
+func (converter *Converter) CheckTools() []ToolStatus {
+	tools := []ToolStatus{}
+	if converter.ImageBackend == ImageBackendMagick {
+		tools = append(tools,
+			ToolStatus{Name: "convert", Path: converter.ConvertPath},
+			ToolStatus{Name: "identify", Path: converter.IdentifyPath})
+	} else {
+		// the native decoder can't read animated webp, its frames are extracted by ImageMagick anyway
+		tools = append(tools, ToolStatus{Name: "convert (animated webp)", Path: converter.ConvertPath})
 	}
+	tools = append(tools,
+		ToolStatus{Name: "ffmpeg", Path: converter.FfmpegPath},
+		ToolStatus{Name: "ffprobe", Path: converter.FfprobePath})
 
-	info.Type = strings.ToLower(args[1])
-	_, err = fmt.Sscanf(args[2], "%dx%d", &info.Sizes.Width, &info.Sizes.Height)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("while identifying %s an error occured %s\n%s", filename, err.Error(), string(output)))
+	for i := range tools {
+		_, err := exec.LookPath(tools[i].Path)
+		if err != nil {
+			tools[i].Err = err
+			continue
+		}
+		output, err := exec.Command(tools[i].Path, "-version").Output()
+		if err != nil {
+			tools[i].Err = errors.New(fmt.Sprintf("while getting the version an error occured %s", err.Error()))
+			continue
+		}
+		tools[i].Version = strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	}
+	return tools
+}
+
+// Status is a human-readable report of the converter settings and its binaries
+func (converter *Converter) Status() string {
+	lines := []string{fmt.Sprintf("Converter: %s images, max %s, jpg quality %s, background %s, preset %s",
+		converter.ImageBackend, converter.MaximumSizes, converter.JpgQuality, converter.Background, converter.Preset)}
+	if converter.Watermark.Enabled() {
+		lines = append(lines, fmt.Sprintf("Watermark: %s, opacity %.2f, scale %.2f",
+			converter.Watermark.Position, converter.Watermark.Opacity, converter.Watermark.Scale))
+	}
+	for _, tool := range converter.CheckTools() {
+		lines = append(lines, tool.String())
 	}
+	return strings.Join(lines, "\n")
+}
 
-	return &info, nil
+// IdentifyImage and the rest of image methods are done by the selected ImageProcessor
+func (converter *Converter) IdentifyImage(filename string) (*ImageInfo, error) {
+	return converter.images.IdentifyImage(filename)
 }
 
 func (converter *Converter) Image(filename string) (string, error) {
+	quality, err := strconv.Atoi(converter.JpgQuality)
+	if err != nil {
+		return "", err
+	}
 	newImg := filename + ".jpg"
-	output, err := exec.Command(converter.ConvertPath, "-strip", "-resize", converter.MaximumSizes, "-quality", converter.JpgQuality, filename, newImg).Output()
+	err = converter.images.ConvertImage(filename, newImg, quality)
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("while converting %s an error occured %s\n%s", filename, err.Error(), string(output)))
+		return "", err
 	}
 	return newImg, nil
 }
@@ -97,13 +206,11 @@ func (converter *Converter) ImageTelegram(filename string) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		if info.IsTooBigForTelegram() {
+		if info.NeedsConversionForTelegram() {
 			newImg := filename + ".jpg"
-			output, err := exec.Command(converter.ConvertPath, "-strip", "-resize", converter.MaximumSizes,
-				"-quality", strconv.Itoa(int(quality)),
-				filename, newImg).Output()
+			err = converter.images.ConvertImage(filename, newImg, int(quality))
 			if err != nil {
-				return "", errors.New(fmt.Sprintf("while converting %s an error occured %s\n%s", filename, err.Error(), string(output)))
+				return "", err
 			}
 			err = os.Rename(newImg, filename)
 			if err != nil {
@@ -122,11 +229,42 @@ type ImageInfo struct {
 	Sizes struct {
 		Height, Width int
 	}
-	Type string
+	Type     string
+	Animated bool
+	Alpha    bool // the image could have transparent pixels, it is known only for png, other formats are converted anyway
 }
 
-func (info *ImageInfo) IsTooBigForTelegram() bool {
-	if info.Size > 5_000_000 || info.Sizes.Width > 3840 || info.Sizes.Height > 3840 {
+// Animation converts an animated gif or webp to a silent mp4, which telegram shows as an animation,
+// animated webp can't be decoded by ffmpeg, so it is turned into a gif by ImageMagick first
+func (converter *Converter) Animation(filename string, info *ImageInfo) (string, error) {
+	source := filename
+	if info.Type == "webp" {
+		if _, err := exec.LookPath(converter.ConvertPath); err != nil {
+			return "", errors.New(fmt.Sprintf("%s is an animated webp, it needs ImageMagick: %s", filename, err.Error()))
+		}
+		source = filename + "_frames.gif"
+		output, err := exec.Command(converter.ConvertPath, filename, "-coalesce", source).CombinedOutput()
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("while converting %s an error occured %s\n%s", filename, err.Error(), string(output)))
+		}
+		defer os.Remove(source)
+	}
+
+	newVideo := filename + "_anim.mp4"
+	output, err := exec.Command(converter.FfmpegPath, "-i", source,
+		"-vcodec", "libx264", "-preset", converter.Preset, "-crf", "23",
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2", "-pix_fmt", "yuv420p", "-an",
+		"-map_metadata", "-1", "-movflags", "+faststart", "-y", newVideo).CombinedOutput()
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("while converting %s an error occured %s\n%s", filename, err.Error(), string(output)))
+	}
+	return newVideo, nil
+}
+
+// NeedsConversionForTelegram tells if telegram would reject the image as a photo, it takes only png and jpeg,
+// or if it has transparency, which telegram would put on its own background instead of Converter.Background
+func (info *ImageInfo) NeedsConversionForTelegram() bool {
+	if info.Size > TelegramMaxPhotoSize || info.Sizes.Width+info.Sizes.Height > TelegramMaxPhotoDimensions || info.Alpha {
 		return true
 	}
 	for _, ext := range []string{"png", "jpg", "jpeg"} {
@@ -136,13 +274,3 @@ func (info *ImageInfo) IsTooBigForTelegram() bool {
 	}
 	return true
 }
-
-func (converter *Converter) Video(filename string) (string, error) {
-	newVideo := filename + "_h264.mp4"
-	output, err := exec.Command("ffmpeg", "-i", filename, "-vcodec", "libx264", "-acodec", "aac", "-y",
-		"-preset", "fast", "-map_metadata", "-1", "-metadata", "meh=t.me/by_meh", newVideo).Output()
-	if err != nil {
-		return "", errors.New(fmt.Sprintf("while converting %s an error occured %s\n%s", filename, err.Error(), string(output)))
-	}
-	return newVideo, nil
-}
@@ -0,0 +1,238 @@
+package channelbot
+
+import (
+	"encoding/json"
+	"fmt"
+	tele "github.com/dontsellfish/telebot_local"
+	"golang.org/x/image/draw"
+	"image"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SimilarImageDistance is the maximum number of different bits of perceptual hashes of similar images
+const SimilarImageDistance = 6
+
+// MediaRecord tells where the file with the given file_unique_id has been queued
+type MediaRecord struct {
+	PostId string `json:"post-id"`
+	Index  int    `json:"index"`
+	Hash   uint64 `json:"hash,omitempty"`
+}
+
+func (record *MediaRecord) MarshalBinary() ([]byte, error) {
+	return json.Marshal(record)
+}
+
+func (record *MediaRecord) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, record)
+}
+
+// imageHash is a difference hash: the image is shrunk to 9x8 grayscale pixels, every bit tells
+// if the pixel is brighter than its right neighbour, so it survives recompression and resizing
+func imageHash(filename string) (uint64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return 0, err
+	}
+
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.BiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	hash := uint64(0)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// hashImages computes perceptual hashes of photos of the post by bot.Media, so they are cached and limited by its workers,
+// files that can't be decoded are left without a hash
+func (bot *ChannelBot) hashImages(post *Post) {
+	owner := bot.TempFiles.NewOwner(post.Id)
+	defer bot.TempFiles.ReleaseOwner(owner)
+	defer bot.Media.Release(owner)
+	for i, file := range post.Files {
+		if file.Type != TelegramFileTypePhoto && file.Type != TelegramFileTypeDocPhoto {
+			continue
+		}
+		hashFile, err := bot.Media.Do(owner, file.cacheKey()+".dhash", func(output string) error {
+			filename, err := bot.downloadTemporary(owner, file.Id)
+			if err != nil {
+				return err
+			}
+			defer bot.TempFiles.Release(filename)
+			hash, err := imageHash(filename)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(output, []byte(strconv.FormatUint(hash, 16)), 0644)
+		})
+		if err != nil {
+			continue
+		}
+		buffer, err := os.ReadFile(hashFile)
+		if err == nil {
+			post.Files[i].Hash, _ = strconv.ParseUint(string(buffer), 16, 64)
+		}
+	}
+}
+
+// findDuplicate looks for the file among queued and published posts except self, stale records are skipped
+func (bot *ChannelBot) findDuplicate(self string, file TgFileInfo, records map[string]*MediaRecord) (*Post, int, bool) {
+	candidates := []*MediaRecord{}
+	if record, ok := records[file.UniqueId]; ok {
+		candidates = append(candidates, record)
+	}
+	if file.Hash != 0 {
+		for uniqueId, record := range records {
+			if uniqueId != file.UniqueId && record.Hash != 0 && bits.OnesCount64(record.Hash^file.Hash) <= SimilarImageDistance {
+				candidates = append(candidates, record)
+			}
+		}
+	}
+
+	for _, record := range candidates {
+		if record.PostId == self {
+			continue
+		}
+		post, err := bot.Database.GetPost(record.PostId)
+		if err != nil {
+			post, err = bot.Database.GetPublished(record.PostId)
+		}
+		if err != nil || record.Index >= len(post.Files) {
+			continue
+		}
+		original := post.Files[record.Index]
+		identical := original.UniqueId == file.UniqueId
+		if identical || (original.Hash != 0 && bits.OnesCount64(original.Hash^file.Hash) <= SimilarImageDistance) {
+			return post, record.Index, identical
+		}
+	}
+	return nil, 0, false
+}
+
+// checkDuplicates hashes the files of a saved post and warns the admin about the same or similar files,
+// which are queued or published already, then the hashes are saved and the files are recorded;
+// it takes a while, so it is meant to be run in its own goroutine
+func (bot *ChannelBot) checkDuplicates(to *tele.Message, post *Post) {
+	bot.hashImages(post)
+
+	records, err := bot.Database.GetMediaRecords()
+	if err != nil {
+		bot.alertAdmins("WHILE LOOKING FOR DUPLICATES", err.Error())
+		return
+	}
+
+	warnings := []string{}
+	for i, file := range post.Files {
+		original, index, identical := bot.findDuplicate(post.Id, file, records)
+		if original == nil {
+			continue
+		}
+		kind := "looks like"
+		if identical {
+			kind = "is the same as"
+		}
+		if len(original.Published) == 0 && len(original.MessagesInChat) > 0 {
+			bot.warnAtQueued(to.Chat, original, index,
+				fmt.Sprintf("Possible duplicate: #%d of the new post %s this file (#%d of queued post %s).", i+1, kind, index+1, original.Id))
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("#%d %s #%d of %s", i+1, kind, index+1, original.describeLocation()))
+	}
+	if len(warnings) > 0 {
+		_, _ = bot.Telegram.Reply(to, "Possible duplicates:\n"+strings.Join(warnings, "\n"), tele.NoPreview)
+	}
+
+	// the post could have been edited meanwhile, so only hashes are put into its current version
+	saved, err := bot.Database.GetPost(post.Id)
+	if err != nil {
+		return // removed or merged already
+	}
+	for i, file := range saved.Files {
+		for _, hashed := range post.Files {
+			if hashed.Hash != 0 && hashed.cacheKey() == file.cacheKey() {
+				saved.Files[i].Hash = hashed.Hash
+			}
+		}
+	}
+	err = bot.Database.EditPost(saved)
+	if err != nil {
+		bot.alertAdmins("WHILE SAVING HASHES OF "+post.Id, err.Error())
+	}
+	bot.recordMedia(saved)
+}
+
+// recordMedia remembers where the files of the post are, it has to be called whenever files are moved between posts
+// or within one, as records keep indexes of files
+func (bot *ChannelBot) recordMedia(posts ...*Post) {
+	for _, post := range posts {
+		for i, file := range post.Files {
+			if file.UniqueId == "" {
+				continue
+			}
+			err := bot.Database.SetMediaRecord(file.UniqueId, &MediaRecord{PostId: post.Id, Index: i, Hash: file.Hash})
+			if err != nil {
+				bot.alertAdmins("WHILE RECORDING FILES OF "+post.Id, err.Error())
+				return
+			}
+		}
+	}
+}
+
+// forgetMedia removes the record of the file, which has been dropped from the post
+func (bot *ChannelBot) forgetMedia(post *Post, file TgFileInfo) {
+	if file.UniqueId == "" {
+		return
+	}
+	records, err := bot.Database.GetMediaRecords()
+	if err != nil {
+		return
+	}
+	if record, ok := records[file.UniqueId]; ok && record.PostId == post.Id {
+		_ = bot.Database.RemMediaRecord(file.UniqueId)
+	}
+}
+
+// warnAtQueued replies with the text to the admin message of the file of the queued post, so the admin could jump to it,
+// the message is forwarded first if it is in the chat of another admin, links to private chats don't exist
+func (bot *ChannelBot) warnAtQueued(chat *tele.Chat, post *Post, index int, text string) {
+	link := post.MessagesInChat[0]
+	if index >= 0 && index < len(post.MessagesInChat) {
+		link = post.MessagesInChat[index]
+	}
+	if link.ChatId != chat.ID {
+		forwarded, err := bot.Telegram.Forward(chat, link)
+		if err != nil {
+			_, _ = bot.Telegram.Send(chat, text)
+			return
+		}
+		link = MessageLink{ChatId: chat.ID, MessageId: forwarded.ID}
+	}
+	_, _ = bot.Telegram.Send(chat, text, &tele.SendOptions{ReplyTo: &tele.Message{ID: link.MessageId, Chat: chat}})
+}
+
+// describeLocation returns a link to the post in the channel if it has been published, queued posts are replied instead,
+// see warnAtQueued
+func (post *Post) describeLocation() string {
+	if len(post.Published) > 0 {
+		if url := post.Published[0].URL(); url != "" {
+			return "a published post " + url
+		}
+		return fmt.Sprintf("published post %s", post.Id)
+	}
+	return fmt.Sprintf("queued post %s", post.Id)
+}
@@ -0,0 +1,119 @@
+package channelbot
+
+import (
+	"bytes"
+	tele "github.com/dontsellfish/telebot_local"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gradient is brighter to the right, or to the left if reversed, with a dark square, so rows differ
+func gradient(width, height int, reversed bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := uint8(x * 255 / width)
+			if reversed {
+				value = 255 - value
+			}
+			if x > width/4 && x < width/2 && y > height/4 && y < height/2 {
+				value /= 4
+			}
+			img.Set(x, y, color.RGBA{R: value, G: value, B: value, A: 0xff})
+		}
+	}
+	return img
+}
+
+func writeImage(t *testing.T, filename string, img image.Image) {
+	buffer := &bytes.Buffer{}
+	var err error
+	if filepath.Ext(filename) == ".jpg" {
+		err = jpeg.Encode(buffer, img, &jpeg.Options{Quality: 60})
+	} else {
+		err = png.Encode(buffer, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filename, buffer.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImageHash(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "original.png")
+	writeImage(t, original, gradient(320, 240, false))
+	originalHash, err := imageHash(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		img     image.Image
+		similar bool
+	}{
+		{"same.png", gradient(320, 240, false), true},
+		{"recompressed.jpg", gradient(320, 240, false), true},
+		{"resized.png", gradient(640, 480, false), true},
+		{"resized.jpg", gradient(160, 120, false), true},
+		{"reversed.png", gradient(320, 240, true), false},
+	}
+	for _, test := range tests {
+		filename := filepath.Join(dir, test.name)
+		writeImage(t, filename, test.img)
+		hash, err := imageHash(filename)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		distance := bits.OnesCount64(hash ^ originalHash)
+		if (distance <= SimilarImageDistance) != test.similar {
+			t.Errorf("%s: the distance is %d, similar has to be %t", test.name, distance, test.similar)
+		}
+	}
+
+	broken := filepath.Join(dir, "broken.png")
+	err = os.WriteFile(broken, []byte("not an image"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = imageHash(broken); err == nil {
+		t.Error("a broken image is hashed")
+	}
+}
+
+func TestWarnAtQueued(t *testing.T) {
+	api := newFakeBotApi(t)
+	bot := &ChannelBot{Telegram: api.Bot}
+	chat := &tele.Chat{ID: 10}
+	post := &Post{Id: "10_5", MessagesInChat: []MessageLink{{ChatId: 10, MessageId: 5}, {ChatId: 10, MessageId: 6}}}
+
+	bot.warnAtQueued(chat, post, 1, "duplicate")
+	post.MessagesInChat = []MessageLink{{ChatId: 20, MessageId: 7}} // the chat of another admin
+	bot.warnAtQueued(chat, post, 0, "duplicate")
+
+	calls := api.Calls()
+	if len(calls) != 3 {
+		t.Fatalf("%d calls are made, want 3: %+v", len(calls), calls)
+	}
+	if calls[0].Method != "sendMessage" || !strings.Contains(calls[0].Params["body"], `"reply_to_message_id":"6"`) {
+		t.Errorf("the file in the same chat is not replied: %+v", calls[0])
+	}
+	if calls[1].Method != "forwardMessage" || !strings.Contains(calls[1].Params["body"], `"from_chat_id":"20"`) {
+		t.Errorf("the file in another chat is not forwarded: %+v", calls[1])
+	}
+	if calls[2].Method != "sendMessage" || !strings.Contains(calls[2].Params["body"], `"reply_to_message_id":"1"`) {
+		t.Errorf("the forwarded file is not replied: %+v", calls[2])
+	}
+}
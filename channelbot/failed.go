@@ -0,0 +1,100 @@
+package channelbot
+
+import (
+	"fmt"
+	tele "github.com/dontsellfish/telebot_local"
+	"strconv"
+	"strings"
+)
+
+// recordFailure counts the unsuccessful attempt to publish the post, after Config.MaxPublishFailures attempts
+// the post is moved from the queue to the quarantine, so it doesn't take its slot every day
+func (bot *ChannelBot) recordFailure(post *Post, failure error) {
+	post.Failures++
+	post.LastError = failure.Error()
+	if post.Failures < bot.Config.MaxPublishFailures {
+		err := bot.Database.EditPost(post)
+		if err != nil {
+			bot.alertAdmins("WHILE COUNTING FAILURES OF "+post.Id, err.Error())
+		}
+		return
+	}
+
+	err := bot.Database.SetFailed(post)
+	if err != nil {
+		bot.alertAdmins("WHILE QUARANTINING "+post.Id, err.Error())
+		return
+	}
+	err = bot.Database.RemPost(post)
+	if err != nil {
+		bot.alertAdmins("WHILE QUARANTINING "+post.Id, err.Error())
+	}
+	bot.alertAdmins(fmt.Sprintf("post %s failed %d times and is quarantined, see /failed", post.Id, post.Failures), post.LastError)
+}
+
+// handleFailed lists quarantined posts, or retries, returns to the queue or discards the one given by its number
+func (bot *ChannelBot) handleFailed(ctx tele.Context) error {
+	posts, err := bot.Database.GetFailed()
+	if err != nil {
+		return err
+	}
+	if len(ctx.Args()) == 0 {
+		if len(posts) == 0 {
+			return ctx.Reply("No quarantined posts.")
+		}
+		lines := make([]string, len(posts))
+		for i, post := range posts {
+			lines[i] = fmt.Sprintf("%d. %s, %d failures %s\n%s", i+1, post.Summary(), post.Failures, post.adminLink(), post.LastError)
+		}
+		return ctx.Reply(strings.Join(lines, "\n\n")+"\n\n/failed retry|edit|discard <number>", tele.NoPreview)
+	}
+
+	if len(ctx.Args()) != 2 {
+		return ctx.Reply("Usage: /failed [retry|edit|discard <number>]")
+	}
+	number, err := strconv.Atoi(ctx.Args()[1])
+	if err != nil || number < 1 || number > len(posts) {
+		return ctx.Reply(fmt.Sprintf("There is no quarantined post #%s, there are %d.", ctx.Args()[1], len(posts)))
+	}
+	post := posts[number-1]
+
+	switch strings.ToLower(ctx.Args()[0]) {
+	case "retry":
+		// the post is queued again, so a new failure is counted and quarantines it as usual
+		err = bot.Database.SetPost(post.Id, post)
+		if err != nil {
+			return err
+		}
+		err = bot.Database.RemFailed(post)
+		if err != nil {
+			return err
+		}
+		return bot.makeChannelPostWithComments(post)
+	case "edit":
+		post.Failures, post.LastError = 0, ""
+		err = bot.Database.SetPost(post.Id, post)
+		if err != nil {
+			return err
+		}
+		err = bot.Database.RemFailed(post)
+		if err != nil {
+			return err
+		}
+		return ctx.Reply(fmt.Sprintf("Post %s is in the queue again, reply to it to edit. %s", post.Id, post.adminLink()), tele.NoPreview)
+	case "discard":
+		err = bot.Database.RemFailed(post)
+		if err != nil {
+			return err
+		}
+		return ctx.Reply(fmt.Sprintf("Post %s is discarded.", post.Id))
+	default:
+		return ctx.Reply("Unknown action " + ctx.Args()[0] + ", it is either retry, edit or discard.")
+	}
+}
+
+func (post *Post) adminLink() string {
+	if len(post.MessagesInChat) == 0 {
+		return ""
+	}
+	return post.MessagesInChat[0].URL()
+}
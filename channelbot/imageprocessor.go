@@ -0,0 +1,211 @@
+package channelbot
+
+import (
+	"errors"
+	"fmt"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// MagickImageProcessor shells out to ImageMagick
+type MagickImageProcessor struct {
+	ConvertPath  string
+	IdentifyPath string
+	MaximumSizes string
+	Background   string
+}
+
+func (magick *MagickImageProcessor) IdentifyImage(filename string) (*ImageInfo, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("while identifying %s an error occured %s", filename, err.Error()))
+	}
+	info := ImageInfo{Size: stat.Size()}
+
+	output, err := exec.Command(magick.IdentifyPath, filename).Output()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("while identifying %s an error occured %s\n%s", filename, err.Error(), string(output)))
+	}
+	args := strings.Split(string(output), " ")
+	if len(args) < 3 {
+		return nil, errors.New(fmt.Sprintf("while identifying %s, weird info has gotten %s", filename, string(output)))
+	}
+
+	info.Type = strings.ToLower(args[1])
+	_, err = fmt.Sscanf(args[2], "%dx%d", &info.Sizes.Width, &info.Sizes.Height)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("while identifying %s an error occured %s\n%s", filename, err.Error(), string(output)))
+	}
+	info.Animated = len(strings.Split(strings.TrimSpace(string(output)), "\n")) > 1 // a line per frame
+	if info.Type == "png" {
+		// %A is True or False in ImageMagick 6, Undefined or the kind of the alpha channel (e.g. Blend) in 7
+		output, err = exec.Command(magick.IdentifyPath, "-format", "%A", filename).Output()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("while identifying %s an error occured %s\n%s", filename, err.Error(), string(output)))
+		}
+		alpha := strings.ToLower(strings.TrimSpace(string(output)))
+		info.Alpha = alpha != "" && alpha != "false" && alpha != "undefined"
+	}
+
+	return &info, nil
+}
+
+func (magick *MagickImageProcessor) ConvertImage(filename string, newFilename string, quality int) error {
+	output, err := exec.Command(magick.ConvertPath, "-background", magick.Background, "-flatten",
+		"-strip", "-resize", magick.MaximumSizes,
+		"-quality", strconv.Itoa(quality),
+		filename, newFilename).Output()
+	if err != nil {
+		return errors.New(fmt.Sprintf("while converting %s an error occured %s\n%s", filename, err.Error(), string(output)))
+	}
+	return nil
+}
+
+// NativeImageProcessor needs no binaries, but knows only png, jpeg, gif, webp, tiff and bmp (heic and avif need ImageMagick),
+// unlike ImageMagick, images are only shrunk to fit the maximum sizes, never enlarged
+type NativeImageProcessor struct {
+	MaximumSizes string
+	Background   color.Color
+}
+
+func (native *NativeImageProcessor) IdentifyImage(filename string) (*ImageInfo, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("while identifying %s an error occured %s", filename, err.Error()))
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("while identifying %s an error occured %s", filename, err.Error()))
+	}
+	info := ImageInfo{Size: stat.Size()}
+
+	header := make([]byte, 30)
+	_, _ = io.ReadFull(file, header)
+	if string(header[:4]) == "RIFF" && string(header[8:16]) == "WEBPVP8X" && header[20]&0x02 != 0 {
+		// animated webp is not supported by the decoder, but its header is enough to know the sizes
+		info.Type, info.Animated = "webp", true
+		info.Sizes.Width = 1 + (int(header[24]) | int(header[25])<<8 | int(header[26])<<16)
+		info.Sizes.Height = 1 + (int(header[27]) | int(header[28])<<8 | int(header[29])<<16)
+		return &info, nil
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	config, format, err := image.DecodeConfig(file)
+	if err == image.ErrFormat {
+		return nil, errors.New(fmt.Sprintf("while identifying %s: the format is not supported natively (heic and avif need ImageMagick)", filename))
+	} else if err != nil {
+		return nil, errors.New(fmt.Sprintf("while identifying %s an error occured %s", filename, err.Error()))
+	}
+	info.Type = format
+	info.Sizes.Width, info.Sizes.Height = config.Width, config.Height
+	info.Alpha = format == "png" && hasAlpha(config.ColorModel)
+
+	if format == "gif" {
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		animation, err := gif.DecodeAll(file)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("while identifying %s an error occured %s", filename, err.Error()))
+		}
+		info.Animated = len(animation.Image) > 1
+	}
+
+	return &info, nil
+}
+
+func (native *NativeImageProcessor) ConvertImage(filename string, newFilename string, quality int) error {
+	var maxWidth, maxHeight int
+	_, err := fmt.Sscanf(native.MaximumSizes, "%dx%d", &maxWidth, &maxHeight)
+	if err != nil {
+		return errors.New(fmt.Sprintf("maximum sizes '%s' are not WIDTHxHEIGHT", native.MaximumSizes))
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return errors.New(fmt.Sprintf("while converting %s an error occured %s", filename, err.Error()))
+	}
+	img, _, err := image.Decode(file)
+	_ = file.Close()
+	if err != nil {
+		return errors.New(fmt.Sprintf("while converting %s an error occured %s", filename, err.Error()))
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > maxWidth {
+		width, height = maxWidth, height*maxWidth/width
+	}
+	if height > maxHeight {
+		width, height = width*maxHeight/height, maxHeight
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	// jpeg has no alpha channel, so transparent pixels are put on the background instead of black
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(result, result.Bounds(), image.NewUniform(native.Background), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(result, result.Bounds(), img, bounds, draw.Over, nil)
+
+	out, err := os.Create(newFilename)
+	if err != nil {
+		return errors.New(fmt.Sprintf("while converting %s an error occured %s", filename, err.Error()))
+	}
+	err = jpeg.Encode(out, result, &jpeg.Options{Quality: quality})
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(newFilename)
+		return errors.New(fmt.Sprintf("while converting %s an error occured %s", filename, err.Error()))
+	}
+	return nil
+}
+
+// hasAlpha tells if images of the color model could have transparent pixels
+func hasAlpha(model color.Model) bool {
+	switch model {
+	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model, color.AlphaModel, color.Alpha16Model:
+		return true
+	}
+	if palette, ok := model.(color.Palette); ok {
+		for _, c := range palette {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseHexColor parses #rrggbb
+func parseHexColor(hex string) (color.RGBA, error) {
+	c := color.RGBA{A: 0xff}
+	_, err := fmt.Sscanf(hex, "#%02x%02x%02x", &c.R, &c.G, &c.B)
+	if err != nil {
+		return c, errors.New(fmt.Sprintf("color '%s' is not #rrggbb", hex))
+	}
+	return c, nil
+}
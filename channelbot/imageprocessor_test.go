@@ -0,0 +1,364 @@
+package channelbot
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 1x1 webp images, the standard library can't encode webp
+const (
+	lossyWebp    = "UklGRiIAAABXRUJQVlA4IBYAAAAwAQCdASoBAAEADsD+JaQAA3AAAAAA"
+	losslessWebp = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+)
+
+type imageFixture struct {
+	name     string
+	write    func(t *testing.T, filename string)
+	typ      string
+	width    int
+	height   int
+	animated bool
+	alpha    bool
+	native   bool // could be decoded without ImageMagick
+}
+
+var imageFixtures = []imageFixture{
+	{name: "transparent.png", write: writeTransparentPng, typ: "png", width: 40, height: 30, alpha: true, native: true},
+	{name: "opaque.png", write: writeOpaquePng, typ: "png", width: 30, height: 40, native: true},
+	{name: "static.gif", write: writeGif(1), typ: "gif", width: 16, height: 8, native: true},
+	{name: "animated.gif", write: writeGif(3), typ: "gif", width: 16, height: 8, animated: true, native: true},
+	{name: "lossy.webp", write: writeBase64(lossyWebp), typ: "webp", width: 1, height: 1, native: true},
+	{name: "lossless.webp", write: writeBase64(losslessWebp), typ: "webp", width: 1, height: 1, native: true},
+	{name: "animated.webp", write: writeAnimatedWebp(512, 1024), typ: "webp", width: 512, height: 1024, animated: true},
+	// only the container headers, there is no encoder at hand, enough to check the native backend rejects them with a hint;
+	// decoding and converting real heic and avif images by ImageMagick is NOT covered by these tests
+	{name: "image.heic", write: writeFtyp("heic"), typ: "heic"},
+	{name: "image.avif", write: writeFtyp("avif"), typ: "avif"},
+}
+
+func writeFile(t *testing.T, filename string, data []byte) {
+	t.Helper()
+	err := os.WriteFile(filename, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTransparentPng(t *testing.T, filename string) {
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 30)) // fully transparent
+	buffer := &bytes.Buffer{}
+	err := png.Encode(buffer, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filename, buffer.Bytes())
+}
+
+func writeOpaquePng(t *testing.T, filename string) {
+	buffer := &bytes.Buffer{}
+	err := png.Encode(buffer, image.NewGray(image.Rect(0, 0, 30, 40)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filename, buffer.Bytes())
+}
+
+func writeGif(frames int) func(t *testing.T, filename string) {
+	return func(t *testing.T, filename string) {
+		animation := &gif.GIF{}
+		for i := 0; i < frames; i++ {
+			frame := image.NewPaletted(image.Rect(0, 0, 16, 8), palette.Plan9)
+			frame.SetColorIndex(i, 0, uint8(i*50))
+			animation.Image = append(animation.Image, frame)
+			animation.Delay = append(animation.Delay, 10)
+		}
+		buffer := &bytes.Buffer{}
+		err := gif.EncodeAll(buffer, animation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filename, buffer.Bytes())
+	}
+}
+
+func writeBase64(data string) func(t *testing.T, filename string) {
+	return func(t *testing.T, filename string) {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filename, decoded)
+	}
+}
+
+func riffChunk(fourCC string, payload []byte) []byte {
+	chunk := append([]byte(fourCC), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func uint24(value int) []byte {
+	return []byte{byte(value), byte(value >> 8), byte(value >> 16)}
+}
+
+// writeAnimatedWebp makes a webp of two 1x1 frames on a canvas of the given sizes,
+// 512 is stored as 0x0001ff, which catches mistakes in reading 24-bit sizes
+func writeAnimatedWebp(width, height int) func(t *testing.T, filename string) {
+	return func(t *testing.T, filename string) {
+		still, err := base64.StdEncoding.DecodeString(lossyWebp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := still[12:] // the VP8 chunk without the RIFF header
+
+		vp8x := append([]byte{0x02, 0, 0, 0}, uint24(width-1)...)
+		vp8x = append(vp8x, uint24(height-1)...)
+		body := append([]byte("WEBP"), riffChunk("VP8X", vp8x)...)
+		body = append(body, riffChunk("ANIM", []byte{0, 0, 0, 0, 0, 0})...)
+		for i := 0; i < 2; i++ {
+			anmf := append(uint24(i), uint24(0)...) // x/2, y/2
+			anmf = append(anmf, uint24(0)...)       // width - 1
+			anmf = append(anmf, uint24(0)...)       // height - 1
+			anmf = append(anmf, uint24(100)...)     // duration, ms
+			anmf = append(anmf, 0)
+			body = append(body, riffChunk("ANMF", append(anmf, frame...))...)
+		}
+		writeFile(t, filename, riffChunk("RIFF", body))
+	}
+}
+
+func writeFtyp(brand string) func(t *testing.T, filename string) {
+	return func(t *testing.T, filename string) {
+		box := []byte{0, 0, 0, 24}
+		box = append(box, []byte("ftyp"+brand)...)
+		box = append(box, 0, 0, 0, 0)
+		box = append(box, []byte("mif1"+brand)...)
+		writeFile(t, filename, box)
+	}
+}
+
+func writeFixtures(t *testing.T) string {
+	directory := t.TempDir()
+	for _, fixture := range imageFixtures {
+		fixture.write(t, filepath.Join(directory, fixture.name))
+	}
+	return directory
+}
+
+func checkInfo(t *testing.T, fixture imageFixture, info *ImageInfo) {
+	t.Helper()
+	if info.Type != fixture.typ || info.Sizes.Width != fixture.width || info.Sizes.Height != fixture.height ||
+		info.Animated != fixture.animated || info.Alpha != fixture.alpha {
+		t.Errorf("%s: got %s %dx%d animated %t alpha %t, want %s %dx%d animated %t alpha %t", fixture.name,
+			info.Type, info.Sizes.Width, info.Sizes.Height, info.Animated, info.Alpha,
+			fixture.typ, fixture.width, fixture.height, fixture.animated, fixture.alpha)
+	}
+}
+
+// checkConverted makes sure the result is a jpeg, which fits the maximum sizes, transparent pixels are on the background
+func checkConverted(t *testing.T, fixture imageFixture, filename string, background color.RGBA) {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := jpeg.Decode(file)
+	if err != nil {
+		t.Fatalf("%s: the result is not a jpeg: %s", fixture.name, err.Error())
+	}
+	if img.Bounds().Dx() > 20 || img.Bounds().Dy() > 20 {
+		t.Errorf("%s: %v doesn't fit 20x20", fixture.name, img.Bounds())
+	}
+	if fixture.name == "transparent.png" {
+		r, g, b, _ := img.At(0, 0).RGBA()
+		near := func(got uint32, want uint8) bool {
+			diff := int(got>>8) - int(want)
+			return diff > -8 && diff < 8
+		}
+		if !near(r, background.R) || !near(g, background.G) || !near(b, background.B) {
+			t.Errorf("%s: transparent pixel became %d,%d,%d, want the background %v", fixture.name, r>>8, g>>8, b>>8, background)
+		}
+	}
+}
+
+func TestNativeImageProcessor(t *testing.T) {
+	directory := writeFixtures(t)
+	background := color.RGBA{R: 0x20, G: 0x80, B: 0xe0, A: 0xff}
+	native := &NativeImageProcessor{MaximumSizes: "20x20", Background: background}
+
+	for _, fixture := range imageFixtures {
+		filename := filepath.Join(directory, fixture.name)
+		info, err := native.IdentifyImage(filename)
+		if fixture.typ == "heic" || fixture.typ == "avif" {
+			if err == nil || !strings.Contains(err.Error(), "ImageMagick") {
+				t.Errorf("%s: want a hint about ImageMagick, got %v", fixture.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", fixture.name, err.Error())
+			continue
+		}
+		checkInfo(t, fixture, info)
+
+		if !fixture.native {
+			continue
+		}
+		converted := filename + ".jpg"
+		err = native.ConvertImage(filename, converted, 90)
+		if err != nil {
+			t.Errorf("%s: %s", fixture.name, err.Error())
+			continue
+		}
+		checkConverted(t, fixture, converted, background)
+	}
+}
+
+func TestMagickImageProcessor(t *testing.T) {
+	for _, tool := range []string{DefaultConvertPath, DefaultIdentifyPath} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip("ImageMagick is not installed")
+		}
+	}
+	directory := writeFixtures(t)
+	magick := &MagickImageProcessor{ConvertPath: DefaultConvertPath, IdentifyPath: DefaultIdentifyPath,
+		MaximumSizes: "20x20", Background: "#2080e0"}
+	background, _ := parseHexColor("#2080e0")
+
+	for _, fixture := range imageFixtures {
+		if fixture.typ == "heic" || fixture.typ == "avif" {
+			continue // not covered, the fixtures are headers only, see imageFixtures
+		}
+		filename := filepath.Join(directory, fixture.name)
+		info, err := magick.IdentifyImage(filename)
+		if err != nil {
+			t.Errorf("%s: %s", fixture.name, err.Error())
+			continue
+		}
+		checkInfo(t, fixture, info)
+
+		converted := filename + ".jpg"
+		err = magick.ConvertImage(filename, converted, 90)
+		if err != nil {
+			t.Errorf("%s: %s", fixture.name, err.Error())
+			continue
+		}
+		checkConverted(t, fixture, converted, background)
+	}
+}
+
+func TestAnimation(t *testing.T) {
+	converter := NewConverter(Converter{ImageBackend: ImageBackendNative})
+	if _, err := exec.LookPath(converter.FfmpegPath); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	_, convertErr := exec.LookPath(converter.ConvertPath)
+	directory := writeFixtures(t)
+
+	for _, fixture := range imageFixtures {
+		if !fixture.animated {
+			continue
+		}
+		filename := filepath.Join(directory, fixture.name)
+		info := &ImageInfo{Type: fixture.typ, Animated: true}
+		video, err := converter.Animation(filename, info)
+		if fixture.typ == "webp" && convertErr != nil {
+			if err == nil || !strings.Contains(err.Error(), "ImageMagick") {
+				t.Errorf("%s: want a hint about ImageMagick, got %v", fixture.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", fixture.name, err.Error())
+			continue
+		}
+		if !isMp4(video) {
+			t.Errorf("%s: %s is not an mp4", fixture.name, video)
+		}
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	tests := []struct {
+		hex   string
+		color color.RGBA
+		err   bool
+	}{
+		{hex: "#000000", color: color.RGBA{A: 0xff}},
+		{hex: "#ffffff", color: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+		{hex: "#20A0e0", color: color.RGBA{R: 0x20, G: 0xa0, B: 0xe0, A: 0xff}},
+		{hex: "ffffff", err: true},
+		{hex: "#fff", err: true},
+		{hex: "#gggggg", err: true},
+		{hex: "", err: true},
+	}
+	for _, test := range tests {
+		c, err := parseHexColor(test.hex)
+		if (err != nil) != test.err || (!test.err && c != test.color) {
+			t.Errorf("parseHexColor(%q) = %v, %v", test.hex, c, err)
+		}
+	}
+}
+
+func TestNeedsConversionForTelegram(t *testing.T) {
+	tests := []struct {
+		name string
+		info ImageInfo
+		want bool
+	}{
+		{"jpeg", ImageInfo{Type: "jpeg", Size: 1000}, false},
+		{"opaque png", ImageInfo{Type: "png", Size: 1000}, false},
+		{"transparent png", ImageInfo{Type: "png", Size: 1000, Alpha: true}, true},
+		{"webp", ImageInfo{Type: "webp", Size: 1000}, true},
+		{"heic", ImageInfo{Type: "heic", Size: 1000}, true},
+		{"heavy jpeg", ImageInfo{Type: "jpeg", Size: TelegramMaxPhotoSize + 1}, true},
+		{"huge jpeg", ImageInfo{Type: "jpeg", Size: 1000, Sizes: struct{ Height, Width int }{Height: 9000, Width: 1001}}, true},
+	}
+	for _, test := range tests {
+		if got := test.info.NeedsConversionForTelegram(); got != test.want {
+			t.Errorf("%s: %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWatermarkImageBackground(t *testing.T) {
+	converter := NewConverter(Converter{ImageBackend: ImageBackendNative, Background: "#2080e0",
+		Watermark: Watermark{Text: "wm", Position: WatermarkBottomRight}})
+	filename := filepath.Join(t.TempDir(), "transparent.png")
+	writeTransparentPng(t, filename)
+
+	err := converter.WatermarkImage(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := jpeg.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, g, b, _ := img.At(0, 0).RGBA()
+	if r>>8 > 0x28 || g>>8 < 0x78 || g>>8 > 0x88 || b>>8 < 0xd8 {
+		t.Errorf("a transparent pixel became %d,%d,%d, want the background #2080e0", r>>8, g>>8, b>>8)
+	}
+}
@@ -0,0 +1,117 @@
+package channelbot
+
+import (
+	"encoding/json"
+	"errors"
+	tele "github.com/dontsellfish/telebot_local"
+	"os"
+	"time"
+)
+
+const JobsPollingInterval = time.Second
+
+// a published post, which could not be deleted, is retried every PublishedDeletionRetryDelay for PublishedDeletionAttempts times
+const (
+	PublishedDeletionAttempts   = 6
+	PublishedDeletionRetryDelay = time.Hour
+)
+
+const (
+	JobDeleteMessage  = "delete-message"
+	JobRemoveFile     = "remove-file" // not added anymore, temporary files are managed by TempFiles
+	JobDeletePost     = "delete-post"
+	JobCommentTimeout = "comment-timeout"
+)
+
+// Job is a delayed action persisted in the database, so it is done even if the bot is restarted in between
+type Job struct {
+	Type     string      `json:"type"`
+	Message  MessageLink `json:"message"`
+	Filename string      `json:"filename,omitempty"`
+	PostId   string      `json:"post-id,omitempty"`
+	Attempt  int         `json:"attempt,omitempty"` // so a retried job is a different member of the queue
+}
+
+func (job *Job) MarshalBinary() ([]byte, error) {
+	return json.Marshal(job)
+}
+
+func (job *Job) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, job)
+}
+
+func (bot *ChannelBot) addJob(job *Job, at time.Time) {
+	err := bot.Database.AddJob(job, at)
+	if err != nil {
+		bot.alertAdmins("WHILE ADDING A JOB "+job.Type, err.Error())
+	}
+}
+
+func (bot *ChannelBot) doJob(job *Job) error {
+	switch job.Type {
+	case JobDeleteMessage:
+		return bot.Telegram.Delete(job.Message)
+	case JobRemoveFile:
+		err := os.Remove(job.Filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	case JobDeletePost:
+		post, err := bot.Database.GetPublished(job.PostId)
+		if err != nil {
+			return err
+		}
+		err = bot.deletePublished(post)
+		if err != nil && job.Attempt+1 < PublishedDeletionAttempts {
+			retry := &Job{Type: JobDeletePost, PostId: job.PostId, Attempt: job.Attempt + 1}
+			if bot.Database.AddJob(retry, time.Now().Add(PublishedDeletionRetryDelay)) == nil {
+				return errors.New(err.Error() + "\nit will be retried in " + PublishedDeletionRetryDelay.String())
+			}
+		}
+		if err != nil {
+			return errors.New(err.Error() + "\nit won't be retried, delete the messages by hand")
+		}
+		return nil
+	case JobCommentTimeout:
+		return bot.commentTimedOut(job)
+	default:
+		return errors.New("unknown job type " + job.Type)
+	}
+}
+
+// startJobsRoutine is the only worker of the jobs queue, jobs which are overdue (e.g. because of a restart) are done at once
+func (bot *ChannelBot) startJobsRoutine() {
+	doDue := func(now time.Time) {
+		jobs, err := bot.Database.GetDueJobs(now)
+		if err != nil {
+			bot.alertAdmins("WHILE GETTING JOBS", err.Error())
+			return
+		}
+		for _, job := range jobs {
+			err = bot.doJob(job)
+			if err != nil {
+				switch job.Type {
+				case JobDeleteMessage:
+					bot.Telegram.OnError(err, bot.Telegram.NewContext(tele.Update{Message: &tele.Message{
+						ID:   job.Message.MessageId,
+						Chat: &tele.Chat{ID: job.Message.ChatId},
+					}}))
+				case JobDeletePost:
+					bot.alertAdmins("WHILE DELETING POST "+job.PostId, err.Error())
+				default:
+					bot.alertAdmins("WHILE DOING A JOB "+job.Type, err.Error())
+				}
+			}
+			err = bot.Database.RemJob(job)
+			if err != nil {
+				bot.alertAdmins("WHILE REMOVING A JOB "+job.Type, err.Error())
+			}
+		}
+	}
+
+	doDue(time.Now())
+	for tick := range time.Tick(JobsPollingInterval) {
+		doDue(tick)
+	}
+}
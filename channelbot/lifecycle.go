@@ -0,0 +1,113 @@
+package channelbot
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// states of a post, every transition is saved before the next step, so an interrupted publishing is resumed
+// from where it stopped: queued --> publishing --> published --> [commented -->] done
+const (
+	PostStateQueued     = "queued"
+	PostStatePublishing = "publishing" // it is being sent to the channel, nobody knows if it is there after a crash
+	PostStatePublished  = "published"  // it is in the channel, links are saved
+	PostStateCommented  = "commented"  // comments are attached
+	PostStateDone       = "done"
+)
+
+// PublishClaimTimeout is longer than any publishing, including conversion of videos, could take
+const PublishClaimTimeout = time.Hour
+
+var ErrPostIsBeingPublished = errors.New("the post is being published already")
+
+// finishPublishing does everything after the post is sent to the channel, it could be repeated safely
+func (bot *ChannelBot) finishPublishing(post *Post) error {
+	if len(post.Comments) == 0 {
+		post.State = PostStateDone
+	}
+	if len(post.Comments) > 0 {
+		_, err := bot.Database.GetPendingComment(post.Published[0].MessageId)
+		if IsErrRedisNotFound(err) { // e.g. a restart right after the post was sent
+			err = bot.awaitComments(post)
+		}
+		if err != nil {
+			bot.alertAdmins("the post is published, but its comment won't be attached", err.Error())
+		}
+	}
+	err := bot.Database.SetPublished(post)
+	if err != nil {
+		bot.alertAdmins("the post is published, but it won't be editable", err.Error())
+	}
+	bot.schedulePublishedDeletion(post)
+
+	if len(post.Comments) > 0 {
+		err = bot.attachEarlyComments(post)
+		if err != nil {
+			bot.alertAdmins("the post is published, but its comment won't be attached", err.Error())
+		}
+	}
+	err = bot.Database.RemPost(post)
+	if err != nil {
+		return err
+	}
+	return bot.Database.ReleasePost(post.Id)
+}
+
+// reconcilePublishing resumes publishing interrupted by a restart, nothing is sent to the channel again:
+// posts which might have been sent are quarantined for admins to check the channel and decide
+func (bot *ChannelBot) reconcilePublishing() {
+	posts, err := bot.Database.GetAllPosts()
+	if err != nil {
+		bot.alertAdmins("WHILE RECONCILING POSTS", err.Error())
+	}
+	for _, post := range posts {
+		switch post.State {
+		case "", PostStateQueued: // claimed just before a crash, it is not sent yet
+			err = bot.Database.ReleasePost(post.Id)
+			if err != nil {
+				bot.alertAdmins("WHILE RECONCILING "+post.Id, err.Error())
+			}
+		case PostStatePublishing:
+			post.State = PostStateQueued
+			post.Failures++
+			post.LastError = "publishing was interrupted, check the channel before retrying"
+			err = bot.Database.SetFailed(post)
+			if err == nil {
+				err = bot.Database.RemPost(post)
+			}
+			if err == nil {
+				err = bot.Database.ReleasePost(post.Id)
+			}
+			if err != nil {
+				bot.alertAdmins("WHILE RECONCILING "+post.Id, err.Error())
+				continue
+			}
+			bot.alertAdmins(fmt.Sprintf("publishing of post %s was interrupted, it might be in the channel, see /failed", post.Id))
+		case PostStatePublished:
+			err = bot.finishPublishing(post)
+			if err != nil {
+				bot.alertAdmins("WHILE RECONCILING "+post.Id, err.Error())
+			}
+		}
+	}
+
+	pendings, err := bot.Database.GetPendingComments()
+	if err != nil {
+		bot.alertAdmins("WHILE RECONCILING COMMENTS", err.Error())
+		return
+	}
+	for _, pending := range pendings {
+		post, err := bot.Database.GetPublished(pending.PostId)
+		if err != nil {
+			bot.alertAdmins("WHILE RECONCILING COMMENTS OF "+pending.PostId, err.Error())
+			continue
+		}
+		if post.State == PostStateCommented || post.State == PostStateDone {
+			err = bot.finishComments(post, pending)
+			if err != nil {
+				bot.alertAdmins("WHILE RECONCILING COMMENTS OF "+pending.PostId, err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package channelbot
+
+import (
+	"errors"
+	"fmt"
+	tele "github.com/dontsellfish/telebot_local"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	MaxMediaGroupSize = 10
+	MaxCaptionLength  = 1024
+	MaxMessageLength  = 4096
+)
+
+const (
+	mediaGroupKindNone = iota // has to be sent alone
+	mediaGroupKindVisual
+	mediaGroupKindDocument
+	mediaGroupKindAudio
+)
+
+// mediaGroupKind tells which medias could be grouped together, telegram allows to mix only photos with videos,
+// documents and audios can be grouped only with medias of the same type, everything else can't be in albums at all
+func mediaGroupKind(media tele.Media) int {
+	switch media.(type) {
+	case *tele.Photo, *tele.Video:
+		return mediaGroupKindVisual
+	case *tele.Document:
+		return mediaGroupKindDocument
+	case *tele.Audio:
+		return mediaGroupKindAudio
+	default:
+		return mediaGroupKindNone
+	}
+}
+
+// fileMediaGroupKind is the same as mediaGroupKind, but for files that are not converted to medias yet
+func fileMediaGroupKind(fileType int, asSources bool) int {
+	switch fileType {
+	case TelegramFileTypeDocPhoto, TelegramFileTypeDocVideo:
+		if asSources {
+			return mediaGroupKindDocument
+		}
+		return mediaGroupKindVisual
+	case TelegramFileTypePhoto, TelegramFileTypeVideo:
+		return mediaGroupKindVisual
+	case TelegramFileTypeAudio:
+		return mediaGroupKindAudio
+	default:
+		return mediaGroupKindNone
+	}
+}
+
+// mediaGroupSizes returns sizes of consecutive groups that could be sent with a single call each
+func mediaGroupSizes(kinds []int) []int {
+	sizes := []int{}
+	for i, kind := range kinds {
+		last := len(sizes) - 1
+		if kind != mediaGroupKindNone && last >= 0 && kinds[i-1] == kind && sizes[last] < MaxMediaGroupSize {
+			sizes[last]++
+		} else {
+			sizes = append(sizes, 1)
+		}
+	}
+	return sizes
+}
+
+func splitMediaGroups(medias []tele.Media) [][]tele.Media {
+	kinds := make([]int, len(medias))
+	for i, media := range medias {
+		kinds[i] = mediaGroupKind(media)
+	}
+	groups := [][]tele.Media{}
+	for _, size := range mediaGroupSizes(kinds) {
+		groups = append(groups, medias[:size])
+		medias = medias[size:]
+	}
+	return groups
+}
+
+// splitText cuts the text on a line break so the head fits the limit, on a space if there is no such line break,
+// and if there is no space either, head is empty; the text is never cut inside a markdown entity or an escape,
+// the length is counted in utf-16 code units of the markdown, so it is never less than telegram's one
+func splitText(text string, limit int) (head string, rest string) {
+	if textLength(text) <= limit {
+		return text, ""
+	}
+	lineCut, wordCut := -1, -1
+	for _, cut := range markdownCuts(text, limit) {
+		switch text[cut] {
+		case '\n':
+			lineCut = cut
+		case ' ':
+			wordCut = cut
+		}
+	}
+	switch {
+	case lineCut > 0:
+		return strings.TrimRight(text[:lineCut], "\n"), strings.TrimLeft(text[lineCut:], "\n")
+	case wordCut > 0:
+		return text[:wordCut], strings.TrimLeft(text[wordCut:], " ")
+	default:
+		return "", text
+	}
+}
+
+// markdownCuts returns offsets, where the MarkdownV2 text could be cut without breaking an escape or an entity,
+// only the ones with the head fitting the limit are returned
+func markdownCuts(text string, limit int) []int {
+	cuts := []int{}
+	open := map[string]bool{} // bold, italic, underline, strikethrough and spoiler
+	opened := 0
+	closing := "" // code and urls are closed with it, there are no entities inside
+	link := false
+	length := 0
+	for i := 0; i < len(text); {
+		if length > limit {
+			break
+		}
+		if opened == 0 && closing == "" && !link {
+			cuts = append(cuts, i)
+		}
+
+		rest, size := text[i:], 0
+		switch {
+		case rest[0] == '\\' && len(rest) > 1:
+			_, size = utf8.DecodeRuneInString(rest[1:])
+			size++
+		case closing != "":
+			if strings.HasPrefix(rest, closing) {
+				size, closing = len(closing), ""
+			}
+		case strings.HasPrefix(rest, "```"):
+			size, closing = 3, "```"
+		case rest[0] == '`':
+			size, closing = 1, "`"
+		case rest[0] == '[':
+			size, link = 1, true
+		case link && strings.HasPrefix(rest, "]("):
+			size, closing, link = 2, ")", false
+		case strings.HasPrefix(rest, "__") || strings.HasPrefix(rest, "||"):
+			size = 2
+		case rest[0] == '*' || rest[0] == '_' || rest[0] == '~':
+			size = 1
+		}
+		if size > 0 && closing == "" && !link && strings.ContainsAny(rest[:1], "*_~|") {
+			marker := rest[:size]
+			if open[marker] {
+				opened--
+			} else {
+				opened++
+			}
+			open[marker] = !open[marker]
+		}
+		if size == 0 {
+			_, size = utf8.DecodeRuneInString(rest)
+		}
+		length += textLength(text[i : i+size])
+		i += size
+	}
+	return cuts
+}
+
+// splitMessageText splits the text into chunks that fit into text messages, breaking lines only if there is no choice
+func splitMessageText(text string) []string {
+	chunks := []string{}
+	for text != "" {
+		head, rest := splitText(text, MaxMessageLength)
+		if head == "" {
+			cut := 0
+			if cuts := markdownCuts(text, MaxMessageLength); len(cuts) > 0 {
+				cut = cuts[len(cuts)-1]
+			}
+			if cut == 0 { // an entity is longer than a message, it is broken anyway
+				length := 0
+				cut = len(text)
+				for i, char := range text {
+					length += len(utf16.Encode([]rune{char}))
+					if length > MaxMessageLength {
+						cut = i
+						break
+					}
+				}
+				for cut > 1 && text[cut-1] == '\\' { // do not break markdown escapes
+					cut--
+				}
+			}
+			head, rest = text[:cut], text[cut:]
+		}
+		chunks = append(chunks, head)
+		text = rest
+	}
+	return chunks
+}
+
+func textLength(text string) int {
+	return len(utf16.Encode([]rune(text)))
+}
+
+// setCaption returns false if the media can't have a caption
+func setCaption(media tele.Media, caption string) bool {
+	switch m := media.(type) {
+	case *tele.Photo:
+		m.Caption = caption
+	case *tele.Video:
+		m.Caption = caption
+	case *tele.Document:
+		m.Caption = caption
+	case *tele.Audio:
+		m.Caption = caption
+	case *tele.Animation:
+		m.Caption = caption
+	case *tele.Voice:
+		m.Caption = caption
+	default:
+		return false
+	}
+	return true
+}
+
+// captionLast puts the caption on the last media that can hold it, returns false if there is no such media
+func captionLast(medias []tele.Media, caption string) bool {
+	for i := len(medias) - 1; i >= 0; i-- {
+		if setCaption(medias[i], caption) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendMediaGroups sends every group with a separate call, messages sent before an error are returned as well,
+// if spoiler is set, photos and videos are hidden under it
+func sendMediaGroups(sender *Sender, to tele.Recipient, groups [][]tele.Media, spoiler bool, opts *tele.SendOptions) ([]tele.Message, error) {
+	messages := []tele.Message{}
+	for _, group := range groups {
+		if spoiler && mediaGroupKind(group[0]) == mediaGroupKindVisual {
+			sent, err := sender.SendSpoilerAlbum(to, group, opts)
+			if err != nil {
+				return messages, err
+			}
+			messages = append(messages, sent...)
+		} else if len(group) == 1 {
+			sendable, ok := group[0].(tele.Sendable)
+			if !ok {
+				return messages, errors.New(fmt.Sprintf("media of type %s can't be sent", group[0].MediaType()))
+			}
+			message, err := sender.Send(to, sendable, opts)
+			if err != nil {
+				return messages, err
+			}
+			messages = append(messages, *message)
+		} else {
+			album := make(tele.Album, len(group))
+			for i, media := range group {
+				inputtable, ok := media.(tele.Inputtable)
+				if !ok {
+					return messages, errors.New(fmt.Sprintf("media of type %s can't be in an album", media.MediaType()))
+				}
+				album[i] = inputtable
+			}
+			sent, err := sender.SendAlbum(to, album, opts)
+			if err != nil {
+				return messages, err
+			}
+			messages = append(messages, sent...)
+		}
+	}
+	return messages, nil
+}
+
+// sendText sends the text split into as many messages as needed
+func sendText(sender *Sender, to tele.Recipient, text string, opts *tele.SendOptions) ([]tele.Message, error) {
+	messages := []tele.Message{}
+	for _, chunk := range splitMessageText(text) {
+		message, err := sender.Send(to, chunk, opts)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, *message)
+	}
+	return messages, nil
+}
@@ -0,0 +1,67 @@
+package channelbot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		head  string
+		rest  string
+	}{
+		{"fits", "short", 10, "short", ""},
+		{"line break", "aaa\nbbb ccc", 9, "aaa", "bbb ccc"},
+		{"space", "aaa bbb ccc", 9, "aaa bbb", "ccc"},
+		{"no space", "aaaaaaaaaaaa", 5, "", "aaaaaaaaaaaa"},
+		{"after bold", "*aaa bbb* ccc", 10, "*aaa bbb*", "ccc"},
+		{"inside bold", "*aaa bbb* ccc", 8, "", "*aaa bbb* ccc"},
+		{"escapes", "a\\*b c\\*d e", 7, "a\\*b", "c\\*d e"},
+		{"underline and italic", "__a _b_ c__ d", 12, "__a _b_ c__", "d"},
+		{"spoiler", "||a b|| c", 8, "||a b||", "c"},
+		{"inline code", "`aa bb` cc", 8, "`aa bb`", "cc"},
+		{"inside inline code", "`aa bb` cc", 6, "", "`aa bb` cc"},
+		{"code block", "```\naa\nbb\n```\ncc", 14, "```\naa\nbb\n```", "cc"},
+		{"inside code block", "```\naa\nbb\n```\ncc", 12, "", "```\naa\nbb\n```\ncc"},
+		{"link", "[aa bb](https://t.me/a) cc", 24, "[aa bb](https://t.me/a)", "cc"},
+		{"inside link", "[aa bb](https://t.me/a) cc", 22, "", "[aa bb](https://t.me/a) cc"},
+		{"utf-16", "😀😀 a", 4, "😀😀", "a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			head, rest := splitText(test.text, test.limit)
+			if head != test.head || rest != test.rest {
+				t.Errorf("splitText(%q, %d) = %q, %q, want %q, %q", test.text, test.limit, head, rest, test.head, test.rest)
+			}
+		})
+	}
+}
+
+func TestSplitMessageText(t *testing.T) {
+	long := strings.Repeat("a", MaxMessageLength-96)
+	tests := []struct {
+		name   string
+		text   string
+		chunks []string
+	}{
+		{"one word", strings.Repeat("a", MaxMessageLength+4), []string{strings.Repeat("a", MaxMessageLength), "aaaa"}},
+		{"before an entity", long + "*" + strings.Repeat("b", 200) + "*", []string{long, "*" + strings.Repeat("b", 200) + "*"}},
+		{"before an escape", strings.Repeat("a", MaxMessageLength-1) + "\\.b", []string{strings.Repeat("a", MaxMessageLength-1), "\\.b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := splitMessageText(test.text)
+			if len(chunks) != len(test.chunks) {
+				t.Fatalf("the text is split into %d chunks, want %d", len(chunks), len(test.chunks))
+			}
+			for i := range chunks {
+				if chunks[i] != test.chunks[i] {
+					t.Errorf("chunk #%d is %d characters long, want %d", i+1, len(chunks[i]), len(test.chunks[i]))
+				}
+			}
+		})
+	}
+}
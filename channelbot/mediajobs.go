@@ -0,0 +1,353 @@
+package channelbot
+
+import (
+	"fmt"
+	tele "github.com/dontsellfish/telebot_local"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMediaWorkers    = 2
+	DefaultMediaCacheQuota = 1_000_000_000 // bytes
+	MediaCacheDirectory    = "cache"
+
+	mediaProgressInterval = time.Second * 2
+)
+
+// MediaJobs downloads and converts files with a bounded number of workers, the same file is never processed twice
+// at once, the results are kept in the cache directory until the quota pushes out the least recently used ones,
+// results are pinned by their owners (e.g. a send of a post) until they are released, so they are not evicted mid-upload
+type MediaJobs struct {
+	Directory string
+	Quota     int64
+
+	slots    chan struct{}
+	mutex    sync.Mutex
+	inFlight map[string]*mediaJob
+	pinned   map[string][]string // owner --> keys
+}
+
+type mediaJob struct {
+	done chan struct{}
+	err  error
+}
+
+func NewMediaJobs(directory string, workers int, quota int64) (*MediaJobs, error) {
+	if workers <= 0 {
+		workers = DefaultMediaWorkers
+	}
+	if quota <= 0 {
+		quota = DefaultMediaCacheQuota
+	}
+	err := createDirectoryIfNotFound(directory)
+	if err != nil {
+		return nil, err
+	}
+	return &MediaJobs{
+		Directory: directory,
+		Quota:     quota,
+		slots:     make(chan struct{}, workers),
+		inFlight:  map[string]*mediaJob{},
+		pinned:    map[string][]string{},
+	}, nil
+}
+
+// Do returns the cached file of the key, if there is none, work is called to write it, work may write
+// additional files named output + "_<suffix>", they are cached along with the output;
+// the file is pinned by the owner, it has to be released by Release afterwards
+func (jobs *MediaJobs) Do(owner string, key string, work func(output string) error) (string, error) {
+	output := path.Join(jobs.Directory, key)
+
+	jobs.mutex.Lock()
+	jobs.pinned[owner] = append(jobs.pinned[owner], key)
+	if job, ok := jobs.inFlight[key]; ok {
+		jobs.mutex.Unlock()
+		<-job.done
+		return output, job.err
+	}
+	if _, err := os.Stat(output); err == nil {
+		jobs.mutex.Unlock()
+		now := time.Now()
+		_ = os.Chtimes(output, now, now)
+		return output, nil
+	}
+	job := &mediaJob{done: make(chan struct{})}
+	jobs.inFlight[key] = job
+	jobs.mutex.Unlock()
+
+	jobs.slots <- struct{}{}
+	job.err = work(output)
+	<-jobs.slots
+	if job.err != nil {
+		_ = os.Remove(output)
+	}
+
+	jobs.mutex.Lock()
+	delete(jobs.inFlight, key)
+	jobs.mutex.Unlock()
+	close(job.done)
+
+	if job.err == nil {
+		jobs.evict()
+	}
+	return output, job.err
+}
+
+// Release unpins the files of the owner, they could be evicted afterwards
+func (jobs *MediaJobs) Release(owner string) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	delete(jobs.pinned, owner)
+}
+
+// Usage returns the number of cached files and their total size
+func (jobs *MediaJobs) Usage() (int, int64) {
+	entries, err := os.ReadDir(jobs.Directory)
+	if err != nil {
+		return 0, 0
+	}
+	files, size := 0, int64(0)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && !entry.IsDir() {
+			files++
+			size += info.Size()
+		}
+	}
+	return files, size
+}
+
+func (jobs *MediaJobs) Status() string {
+	files, size := jobs.Usage()
+	jobs.mutex.Lock()
+	inFlight := len(jobs.inFlight)
+	jobs.mutex.Unlock()
+	return fmt.Sprintf("Media cache: %d files, %.1f/%.1f MB, %d in progress (%d workers)",
+		files, float64(size)/1e6, float64(jobs.Quota)/1e6, inFlight, cap(jobs.slots))
+}
+
+// evict removes the least recently used files until the cache fits the quota, files of jobs in flight and pinned ones are kept
+func (jobs *MediaJobs) evict() {
+	entries, err := os.ReadDir(jobs.Directory)
+	if err != nil {
+		return
+	}
+	infos := []os.FileInfo{}
+	size := int64(0)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && !entry.IsDir() {
+			infos = append(infos, info)
+			size += info.Size()
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	for _, info := range infos {
+		if size <= jobs.Quota {
+			return
+		}
+		if jobs.isInUse(info.Name()) {
+			continue
+		}
+		if os.Remove(path.Join(jobs.Directory, info.Name())) == nil {
+			size -= info.Size()
+		}
+	}
+}
+
+func (jobs *MediaJobs) isInUse(name string) bool {
+	isOf := func(key string) bool {
+		return name == key || strings.HasPrefix(name, key+"_")
+	}
+	for key := range jobs.inFlight {
+		if isOf(key) {
+			return true
+		}
+	}
+	for _, keys := range jobs.pinned {
+		for _, key := range keys {
+			if isOf(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mediaProgress reports to the admin how many files are ready, the message is deleted when everything is done
+type mediaProgress struct {
+	bot     *tele.Bot
+	message *tele.Message
+	total   int
+	done    int
+	edited  time.Time
+	mutex   sync.Mutex
+}
+
+func newMediaProgress(bot *tele.Bot, to tele.Recipient, total int) *mediaProgress {
+	progress := &mediaProgress{bot: bot, total: total, edited: time.Now()}
+	if to != nil && total > 0 {
+		progress.message, _ = bot.Send(to, fmt.Sprintf("Preparing files: 0/%d", total))
+	}
+	return progress
+}
+
+func (progress *mediaProgress) step() {
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.done++
+	if progress.message != nil && progress.done < progress.total && time.Since(progress.edited) >= mediaProgressInterval {
+		progress.edited = time.Now()
+		_, _ = progress.bot.Edit(progress.message, fmt.Sprintf("Preparing files: %d/%d", progress.done, progress.total))
+	}
+}
+
+func (progress *mediaProgress) finish() {
+	if progress.message != nil {
+		_ = progress.bot.Delete(progress.message)
+	}
+}
+
+// progressRecipient returns the chat to report the progress of preparing files to, nil for the channel and the comments
+func (bot *ChannelBot) progressRecipient(to tele.Recipient) tele.Recipient {
+	switch to.Recipient() {
+	case fmt.Sprint(bot.Config.ChannelId), fmt.Sprint(bot.Config.CommentsId):
+		return nil
+	default:
+		return to
+	}
+}
+
+// photoForTelegram downloads the photo and recompresses it if telegram wouldn't take it, the watermark is put afterwards,
+// animated images are turned into mp4 animations
+func (bot *ChannelBot) photoForTelegram(owner string, postFile TgFileInfo, watermark bool) (tele.Media, error) {
+	key := postFile.cacheKey()
+	if watermark {
+		key += "." + bot.Converter.Watermark.key()
+	}
+	converted, err := bot.Media.Do(owner, key+".photo", func(output string) error {
+		localFileName, err := bot.downloadTemporary(owner, postFile.Id)
+		if err != nil {
+			return err
+		}
+		defer bot.TempFiles.Release(localFileName)
+
+		info, err := bot.Converter.IdentifyImage(localFileName)
+		if err != nil {
+			return err
+		}
+		if info.Animated {
+			animation, err := bot.Converter.Animation(localFileName, info)
+			if err != nil {
+				return err
+			}
+			if watermark {
+				video, err := bot.Converter.ProbeVideo(animation)
+				if err != nil {
+					return err
+				}
+				animation, err = bot.Converter.WatermarkVideo(animation, video)
+				if err != nil {
+					return err
+				}
+			}
+			return os.Rename(animation, output)
+		}
+
+		_, err = bot.Converter.ImageTelegram(localFileName)
+		if err != nil {
+			return err
+		}
+		if watermark {
+			err = bot.Converter.WatermarkImage(localFileName)
+			if err != nil {
+				return err
+			}
+			// the watermarked photo is encoded in the full quality, which could be too much again
+			_, err = bot.Converter.ImageTelegram(localFileName)
+			if err != nil {
+				return err
+			}
+		}
+		return os.Rename(localFileName, output)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if isMp4(converted) {
+		return &tele.Animation{File: tele.FromDisk(converted), FileName: "animation.mp4", MIME: "video/mp4"}, nil
+	}
+	return &tele.Photo{File: tele.FromDisk(converted)}, nil
+}
+
+func isMp4(filename string) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	header := make([]byte, 8)
+	_, err = io.ReadFull(file, header)
+	return err == nil && string(header[4:8]) == "ftyp"
+}
+
+// videoForTelegram is photoForTelegram for videos, see Converter.Video
+func (bot *ChannelBot) videoForTelegram(owner string, postFile TgFileInfo, watermark bool) (*tele.Video, error) {
+	key := postFile.cacheKey()
+	if watermark {
+		key += "." + bot.Converter.Watermark.key()
+	}
+	converted, err := bot.Media.Do(owner, key+".mp4", func(output string) error {
+		localFileName, err := bot.downloadTemporary(owner, postFile.Id)
+		if err != nil {
+			return err
+		}
+		defer bot.TempFiles.Release(localFileName) // the converted video and the thumbnail are named after it as well
+
+		result, err := bot.Converter.Video(localFileName)
+		if err != nil {
+			return err
+		}
+		if result.Thumbnail != "" {
+			_ = os.Rename(result.Thumbnail, output+"_thumb.jpg")
+		}
+		if watermark {
+			result.Filename, err = bot.Converter.WatermarkVideo(result.Filename, result.Info)
+			if err != nil {
+				return err
+			}
+		}
+		return os.Rename(result.Filename, output)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := bot.Converter.ProbeVideo(converted)
+	if err != nil {
+		return nil, err
+	}
+	video := &tele.Video{
+		File:      tele.FromDisk(converted),
+		Width:     info.Width,
+		Height:    info.Height,
+		Duration:  int(math.Round(info.Duration)),
+		Streaming: true,
+	}
+	if _, err = os.Stat(converted + "_thumb.jpg"); err == nil {
+		video.Thumbnail = &tele.Photo{File: tele.FromDisk(converted + "_thumb.jpg")}
+	}
+	return video, nil
+}
@@ -0,0 +1,39 @@
+package channelbot
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMediaJobsPinning(t *testing.T) {
+	jobs, err := NewMediaJobs(t.TempDir(), 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(output string) error {
+		return os.WriteFile(output, []byte("8 bytes!"), 0644)
+	}
+
+	first, err := jobs.Do("sending", "first", write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour) // the least recently used one
+	_ = os.Chtimes(first, past, past)
+	if _, err = jobs.Do("preview", "second", write); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(first) {
+		t.Fatal("a pinned file is evicted")
+	}
+
+	jobs.Release("sending")
+	jobs.Release("preview")
+	if _, err = jobs.Do("another", "third", write); err != nil {
+		t.Fatal(err)
+	}
+	if exists(first) {
+		t.Error("the least recently used file is not evicted after it is released")
+	}
+}
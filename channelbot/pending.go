@@ -0,0 +1,160 @@
+package channelbot
+
+import (
+	"encoding/json"
+	"fmt"
+	tele "github.com/dontsellfish/telebot_local"
+	"time"
+)
+
+// PendingComment is a published post waiting for its auto-forward to the comments chat, it is kept in the database,
+// so the comments are attached even if the forward comes late or the bot is restarted in between
+type PendingComment struct {
+	PostId    string        `json:"post-id"`
+	MessageId int           `json:"message-id"` // the first message of the post in the channel
+	Published []MessageLink `json:"published"`
+	Since     time.Time     `json:"since"`
+	Forward   *MessageLink  `json:"forward,omitempty"` // the forward, which has come before the post was saved as published
+}
+
+func (pending *PendingComment) MarshalBinary() ([]byte, error) {
+	return json.Marshal(pending)
+}
+
+func (pending *PendingComment) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, pending)
+}
+
+// awaitComments makes the post pending until the forward arrives or the timeout passes, it is called right after the post
+// is sent, as the forward could come before the post is saved as published
+func (bot *ChannelBot) awaitComments(post *Post) error {
+	pending := &PendingComment{
+		PostId:    post.Id,
+		MessageId: post.Published[0].MessageId,
+		Published: post.Published,
+		Since:     time.Now(),
+	}
+	err := bot.Database.SetPendingComment(pending)
+	if err != nil {
+		return err
+	}
+	bot.addJob(&Job{Type: JobCommentTimeout, PostId: post.Id, Message: post.Published[0]},
+		pending.Since.Add(time.Second*time.Duration(bot.Config.CommentTimeout)))
+	return nil
+}
+
+// attachComments replies with the comments of the post to its forward in the comments chat, a forward which has come
+// before the post is saved as published is kept in the pending comment and attached by attachEarlyComments
+func (bot *ChannelBot) attachComments(forward *tele.Message) error {
+	bot.comments.Lock()
+	defer bot.comments.Unlock()
+
+	pending, err := bot.Database.GetPendingComment(forward.OriginalMessageID)
+	if IsErrRedisNotFound(err) {
+		pending, err = bot.pendingOfPublished(forward.OriginalMessageID)
+	}
+	if IsErrRedisNotFound(err) {
+		return nil
+	}
+	if err != nil || pending == nil {
+		return err
+	}
+	post, err := bot.Database.GetPublished(pending.PostId)
+	if IsErrRedisNotFound(err) {
+		pending.Forward = &MessageLink{forward.Chat.ID, forward.ID}
+		return bot.Database.SetPendingComment(pending)
+	}
+	if err != nil {
+		return err
+	}
+	return bot.sendComments(post, pending, forward)
+}
+
+// attachEarlyComments attaches the comments of the post, whose forward has come before the post was saved as published
+func (bot *ChannelBot) attachEarlyComments(post *Post) error {
+	bot.comments.Lock()
+	defer bot.comments.Unlock()
+
+	pending, err := bot.Database.GetPendingComment(post.Published[0].MessageId)
+	if IsErrRedisNotFound(err) {
+		return nil // attached already
+	}
+	if err != nil || pending.Forward == nil {
+		return err
+	}
+	saved, err := bot.Database.GetPublished(post.Id)
+	if err != nil {
+		return err
+	}
+	return bot.sendComments(saved, pending, &tele.Message{ID: pending.Forward.MessageId, Chat: &tele.Chat{ID: pending.Forward.ChatId}})
+}
+
+// pendingOfPublished makes up the pending comment of a published post, whose record is missing, e.g. it couldn't be saved,
+// nil is returned if the post has no comments to attach
+func (bot *ChannelBot) pendingOfPublished(idInChannel int) (*PendingComment, error) {
+	post, err := bot.Database.GetPublishedByChannelMessage(idInChannel)
+	if err != nil {
+		return nil, err
+	}
+	if post.State != PostStatePublished || len(post.Comments) == 0 || len(post.Published) == 0 {
+		return nil, nil
+	}
+	return &PendingComment{PostId: post.Id, MessageId: post.Published[0].MessageId, Published: post.Published, Since: time.Now()}, nil
+}
+
+// sendComments replies with the comments, which have not been sent yet, to the forward and completes the post
+func (bot *ChannelBot) sendComments(post *Post, pending *PendingComment, forward *tele.Message) error {
+	if post.State == PostStateCommented || post.State == PostStateDone { // e.g. the forward is delivered twice
+		return bot.finishComments(post, pending)
+	}
+
+	for _, comment := range post.Comments {
+		if len(comment.Published) > 0 {
+			continue
+		}
+		messages, err := comment.SendReply(bot, MessageLink{forward.Chat.ID, forward.ID})
+		if err != nil {
+			bot.Telegram.OnError(err, bot.Telegram.NewContext(tele.Update{Message: forward}))
+		}
+		comment.Published = messagesToLinks(messages)
+		err = bot.Database.SetPublished(post) // so sent comments are not sent again
+		if err != nil {
+			bot.Telegram.OnError(err, bot.Telegram.NewContext(tele.Update{Message: forward}))
+		}
+	}
+	post.State = PostStateCommented
+	err := bot.Database.SetPublished(post)
+	if err != nil {
+		return err
+	}
+	return bot.finishComments(post, pending)
+}
+
+// finishComments forgets the pending comment and completes the post
+func (bot *ChannelBot) finishComments(post *Post, pending *PendingComment) error {
+	err := bot.Database.RemPendingComment(pending)
+	if err != nil {
+		return err
+	}
+	post.State = PostStateDone
+	return bot.Database.SetPublished(post)
+}
+
+// commentTimedOut alerts admins if the comments of the post have not been attached in time, they won't be anymore
+func (bot *ChannelBot) commentTimedOut(job *Job) error {
+	pending, err := bot.Database.GetPendingComment(job.Message.MessageId)
+	if IsErrRedisNotFound(err) || (err == nil && pending.PostId != job.PostId) {
+		return nil // attached already
+	}
+	if err != nil {
+		return err
+	}
+
+	bot.alertAdmins(fmt.Sprintf("the comment of post %s was never attached, no forward came in %s",
+		pending.PostId, time.Since(pending.Since).Round(time.Second)), pending.Published[0].URL())
+	post, err := bot.Database.GetPublished(pending.PostId)
+	if err != nil {
+		return bot.Database.RemPendingComment(pending)
+	}
+	return bot.finishComments(post, pending)
+}
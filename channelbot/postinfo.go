@@ -3,10 +3,11 @@ package channelbot
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	tele "github.com/dontsellfish/telebot_local"
-	"os"
-	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,7 +22,8 @@ struct PostInfo:
 	msg_id_in_comments_chat_channel_posted - int
 	original_msg_ids	- List[int]
 
-TelegramFileType - enum (TelegramFileTypePhoto, TelegramFileTypeVideo, TelegramFileTypeDocPhoto, TelegramFileTypeDocVideo)
+TelegramFileType - enum (TelegramFileTypePhoto, TelegramFileTypeVideo, TelegramFileTypeDocPhoto, TelegramFileTypeDocVideo,
+	TelegramFileTypeAudio, TelegramFileTypeAnimation, TelegramFileTypeVoice, TelegramFileTypeSticker)
 */
 
 const (
@@ -35,6 +37,10 @@ const (
 	TelegramFileTypeVideo
 	TelegramFileTypeDocPhoto
 	TelegramFileTypeDocVideo
+	TelegramFileTypeAudio
+	TelegramFileTypeAnimation
+	TelegramFileTypeVoice
+	TelegramFileTypeSticker
 )
 
 const (
@@ -48,9 +54,20 @@ const (
 
 const TimeIsNotSpecified = "NA"
 
+const ExpirationTimeLayout = "2006-01-02 15:04"
+
 type TgFileInfo struct {
-	Type int
-	Id   string
+	Type     int
+	Id       string
+	UniqueId string `json:",omitempty"` // the same for every bot, so it keys the converted files
+	Hash     uint64 `json:",omitempty"` // perceptual hash of images, see imageHash, 0 means none (or a plain image)
+}
+
+func (file TgFileInfo) cacheKey() string {
+	if file.UniqueId != "" {
+		return file.UniqueId
+	}
+	return file.Id
 }
 
 type MessageLink struct {
@@ -58,24 +75,77 @@ type MessageLink struct {
 	MessageId int   `json:"message-id"`
 }
 
+func (link MessageLink) MessageSig() (string, int64) {
+	return strconv.Itoa(link.MessageId), link.ChatId
+}
+
+// URL returns a link to the message, it exists only for supergroups and channels, otherwise it is empty
+func (link MessageLink) URL() string {
+	chat := strconv.FormatInt(link.ChatId, 10)
+	if !strings.HasPrefix(chat, "-100") || link.MessageId == 0 {
+		return ""
+	}
+	return fmt.Sprintf("https://t.me/c/%s/%d", strings.TrimPrefix(chat, "-100"), link.MessageId)
+}
+
+func messagesToLinks(messages []tele.Message) []MessageLink {
+	links := make([]MessageLink, len(messages))
+	for i, msg := range messages {
+		links[i] = MessageLink{ChatId: msg.Chat.ID, MessageId: msg.ID}
+	}
+	return links
+}
+
 type Post struct {
 	Id             string        `json:"id"`
 	ScheduledTime  string        `json:"time"`
 	MessagesInChat []MessageLink `json:"admin-messages"`
 
-	AsSources bool         `json:"sources,omitempty"`
-	Text      string       `json:"text,omitempty"`
-	Protected bool         `json:"protected,omitempty"`
-	Reply     MessageLink  `json:"reply,omitempty"`
-	Files     []TgFileInfo `json:"files"`
+	AsSources   bool               `json:"sources,omitempty"`
+	Text        string             `json:"text,omitempty"`
+	Protected   bool               `json:"protected,omitempty"`
+	Spoiler     bool               `json:"spoiler,omitempty"`
+	Silent      bool               `json:"silent,omitempty"`
+	NoWatermark bool               `json:"no-watermark,omitempty"`
+	NoPreview   bool               `json:"no-preview,omitempty"`
+	Reply       MessageLink        `json:"reply,omitempty"`
+	Files       []TgFileInfo       `json:"files"`
+	Tags        []string           `json:"tags,omitempty"`
+	Source      *SourceAttribution `json:"source,omitempty"`
+	Published   []MessageLink      `json:"published,omitempty"`
+
+	ExpiresAfter time.Duration `json:"expires-after,omitempty"`
+	DeleteAt     int64         `json:"delete-at,omitempty"`
 
-	Comment *Post `json:"comment,omitempty"`
+	State     string `json:"state,omitempty"`    // PostState..., empty for queued posts saved before states
+	Failures  int    `json:"failures,omitempty"` // unsuccessful attempts to publish the post
+	LastError string `json:"last-error,omitempty"`
+
+	Comments []*Post `json:"comments,omitempty"`
 }
 
 func (post *Post) MarshalBinary() ([]byte, error) {
 	return json.Marshal(post)
 }
 
+// UnmarshalJSON also reads the single comment posts were stored with before
+func (post *Post) UnmarshalJSON(data []byte) error {
+	type plainPost Post
+	var decoded struct {
+		plainPost
+		Comment *Post `json:"comment,omitempty"`
+	}
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+	*post = Post(decoded.plainPost)
+	if decoded.Comment != nil {
+		post.Comments = append([]*Post{decoded.Comment}, post.Comments...)
+	}
+	return nil
+}
+
 func (post *Post) UnmarshalBinary(data []byte) error {
 	return json.Unmarshal(data, &post)
 }
@@ -87,93 +157,96 @@ func (post *Post) GetPoster() int64 {
 	return post.MessagesInChat[0].ChatId
 }
 
-func (post *Post) ToAlbum(bot *ChannelBot) (tele.Album, error) {
-	album := tele.Album{}
-	for i, postFile := range post.Files {
-		caption := ""
-		if i+1 == len(post.Files) {
-			caption = post.Text
+func (post *Post) HasTag(tag string) bool {
+	return contains(post.Tags, normalizeTag(tag))
+}
+
+func (post *Post) AddTags(tags ...string) {
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag != "" && !contains(post.Tags, tag) {
+			post.Tags = append(post.Tags, tag)
+		}
+	}
+}
+
+// ToAlbum converts files to medias ready to be sent, see splitMediaGroups, documents (and watermarked files) are prepared by bot.Media,
+// temporary files are made for the owner, if progress is not nil, it is told how many of them are ready
+func (post *Post) ToAlbum(bot *ChannelBot, owner string, progress tele.Recipient) ([]tele.Media, error) {
+	medias := make([]tele.Media, len(post.Files))
+	errs := make([]error, len(post.Files))
+	watermark := bot.Converter.Watermark.Enabled() && !post.NoWatermark
+	prepared := func(fileType int) bool {
+		switch fileType {
+		case TelegramFileTypeDocPhoto, TelegramFileTypeDocVideo:
+			return true
+		case TelegramFileTypePhoto, TelegramFileTypeVideo:
+			return watermark
+		default:
+			return false
+		}
+	}
+	preparing := 0
+	for _, postFile := range post.Files {
+		if prepared(postFile.Type) {
+			preparing++
 		}
+	}
+	report := newMediaProgress(bot.Telegram, progress, preparing)
+	defer report.finish()
 
+	wg := sync.WaitGroup{}
+	for i, postFile := range post.Files {
 		file := tele.File{FileID: postFile.Id}
-		switch postFile.Type {
-		case TelegramFileTypePhoto:
-			album = append(album, &tele.Photo{
-				File:    file,
-				Caption: caption,
-			})
-		case TelegramFileTypeVideo:
-			album = append(album, &tele.Video{
-				File:    file,
-				Caption: caption,
-			})
-		case TelegramFileTypeDocPhoto:
-			localFileName := path.Join(bot.Config.TemporaryFilesDirectory, postFile.Id)
-			err := bot.Telegram.Download(&file, localFileName)
-			if err != nil {
-				return nil, err
-			}
-			go func() {
-				time.Sleep(time.Minute * 5)
-				_ = os.Remove(localFileName)
-			}()
-
-			//imageForTelegram, err := bot.Converter.ImageTelegram(localFileName)
-			//if err != nil {
-			//	return nil, err
-			//}
-			go func() {
-				time.Sleep(time.Minute * 5)
-				//_ = os.Remove(imageForTelegram)
-				//if imageForTelegram != localFileName {
-				_ = os.Remove(localFileName)
-				//}
-			}()
-
-			album = append(album, &tele.Photo{
-				File:    tele.FromDisk(localFileName),
-				Caption: caption,
-			})
-		case TelegramFileTypeDocVideo:
-			localFileName := path.Join(bot.Config.TemporaryFilesDirectory, postFile.Id)
-			err := bot.Telegram.Download(&file, localFileName)
-			if err != nil {
-				return nil, err
-			}
-			go func() {
-				time.Sleep(time.Minute * 5)
-				_ = os.Remove(localFileName)
-			}()
-			album = append(album, &tele.Video{
-				File:    tele.FromDisk(localFileName),
-				Caption: caption,
-			})
+		switch {
+		case prepared(postFile.Type):
+			wg.Add(1)
+			go func(i int, postFile TgFileInfo) {
+				defer wg.Done()
+				defer report.step()
+				if postFile.Type == TelegramFileTypePhoto || postFile.Type == TelegramFileTypeDocPhoto {
+					medias[i], errs[i] = bot.photoForTelegram(owner, postFile, watermark)
+				} else {
+					medias[i], errs[i] = bot.videoForTelegram(owner, postFile, watermark)
+				}
+			}(i, postFile)
+		case postFile.Type == TelegramFileTypePhoto:
+			medias[i] = &tele.Photo{File: file}
+		case postFile.Type == TelegramFileTypeVideo:
+			medias[i] = &tele.Video{File: file}
+		case postFile.Type == TelegramFileTypeAudio:
+			medias[i] = &tele.Audio{File: file}
+		case postFile.Type == TelegramFileTypeAnimation:
+			medias[i] = &tele.Animation{File: file}
+		case postFile.Type == TelegramFileTypeVoice:
+			medias[i] = &tele.Voice{File: file}
+		case postFile.Type == TelegramFileTypeSticker:
+			medias[i] = &tele.Sticker{File: file}
 		}
 	}
+	wg.Wait()
 
+	album := []tele.Media{}
+	for i, media := range medias {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if media != nil {
+			album = append(album, media)
+		}
+	}
 	return album, nil
 }
 
-func (post *Post) ToDocumentsAlbum() (tele.Album, error) {
-	album := tele.Album{}
-	for i, postFile := range post.Files {
-		caption := ""
-		if i+1 == len(post.Files) {
-			caption = post.Text
-		}
-
+func (post *Post) ToDocumentsAlbum() ([]tele.Media, error) {
+	album := []tele.Media{}
+	for _, postFile := range post.Files {
 		file := tele.File{FileID: postFile.Id}
 		switch postFile.Type {
 		case TelegramFileTypeDocPhoto:
-			album = append(album, &tele.Document{
-				File:    file,
-				Caption: caption,
-			})
+			album = append(album, &tele.Document{File: file})
 		case TelegramFileTypeDocVideo:
-			album = append(album, &tele.Document{
-				File:    file,
-				Caption: caption,
-			})
+			album = append(album, &tele.Document{File: file})
 		}
 	}
 	return album, nil
@@ -186,11 +259,179 @@ func (post *Post) SendReply(bot *ChannelBot, message MessageLink) ([]tele.Messag
 
 func (post *Post) ToSendOptions() *tele.SendOptions {
 	return &tele.SendOptions{
-		ReplyTo:           &tele.Message{ID: post.Reply.MessageId, Chat: &tele.Chat{ID: post.Reply.ChatId}},
-		ParseMode:         DefaultParseMode,
-		Protected:         post.Protected,
-		AllowWithoutReply: true,
+		ReplyTo:               &tele.Message{ID: post.Reply.MessageId, Chat: &tele.Chat{ID: post.Reply.ChatId}},
+		ParseMode:             DefaultParseMode,
+		Protected:             post.Protected,
+		DisableNotification:   post.Silent,
+		DisableWebPagePreview: post.NoPreview,
+		AllowWithoutReply:     true,
+	}
+}
+
+// DeletionTime returns when the post published at the given time has to be deleted, zero time if never
+func (post *Post) DeletionTime(published time.Time) time.Time {
+	switch {
+	case post.DeleteAt != 0:
+		return time.Unix(post.DeleteAt, 0)
+	case post.ExpiresAfter != 0:
+		return published.Add(post.ExpiresAfter)
+	default:
+		return time.Time{}
+	}
+}
+
+func (post *Post) ExpirationString() string {
+	switch {
+	case post.DeleteAt != 0:
+		return "at " + time.Unix(post.DeleteAt, 0).Format(ExpirationTimeLayout)
+	case post.ExpiresAfter != 0:
+		return "after " + post.ExpiresAfter.String()
+	default:
+		return "never"
+	}
+}
+
+// captionIndex returns index of the file which holds the caption, -1 if there is no such file
+func (post *Post) captionIndex() int {
+	for i := len(post.Files) - 1; i >= 0; i-- {
+		if post.Files[i].Type != TelegramFileTypeSticker {
+			return i
+		}
+	}
+	return -1
+}
+
+// MoveFile moves the file together with its message in the admin chat
+func (post *Post) MoveFile(from int, to int) error {
+	if from < 0 || from >= len(post.Files) || to < 0 || to >= len(post.Files) {
+		return errors.New(fmt.Sprintf("the file can't be moved from #%d to #%d, there are %d files", from+1, to+1, len(post.Files)))
+	}
+	post.Files[from], post.Files[to] = post.Files[to], post.Files[from]
+	if from < len(post.MessagesInChat) && to < len(post.MessagesInChat) {
+		post.MessagesInChat[from], post.MessagesInChat[to] = post.MessagesInChat[to], post.MessagesInChat[from]
+	}
+	return nil
+}
+
+func (post *Post) DropFile(index int) error {
+	if index < 0 || index >= len(post.Files) {
+		return errors.New(fmt.Sprintf("there is no file #%d, there are %d files", index+1, len(post.Files)))
+	}
+	if len(post.Files) == 1 {
+		return errors.New("the only file can't be dropped, remove the post instead")
+	}
+	post.Files = append(post.Files[:index], post.Files[index+1:]...)
+	if index < len(post.MessagesInChat) && len(post.MessagesInChat) > 1 {
+		post.MessagesInChat = append(post.MessagesInChat[:index], post.MessagesInChat[index+1:]...)
 	}
+	return nil
+}
+
+// ReplaceFile replaces the file, the message of the new file replaces the old one in the admin chat
+func (post *Post) ReplaceFile(index int, file TgFileInfo, message MessageLink) error {
+	if index < 0 || index >= len(post.Files) {
+		return errors.New(fmt.Sprintf("there is no file #%d, there are %d files", index+1, len(post.Files)))
+	}
+	post.Files[index] = file
+	if index < len(post.MessagesInChat) {
+		post.MessagesInChat[index] = message
+	}
+	return nil
+}
+
+// AddComment appends the comment, every comment is sent as a reply of its own
+func (post *Post) AddComment(comment *Post) {
+	post.Comments = append(post.Comments, comment)
+}
+
+func (post *Post) MoveComment(from int, to int) error {
+	if from < 0 || from >= len(post.Comments) || to < 0 || to >= len(post.Comments) {
+		return errors.New(fmt.Sprintf("the comment can't be moved from #%d to #%d, there are %d comments", from+1, to+1, len(post.Comments)))
+	}
+	comment := post.Comments[from]
+	post.Comments = append(post.Comments[:from], post.Comments[from+1:]...)
+	post.Comments = append(post.Comments[:to], append([]*Post{comment}, post.Comments[to:]...)...)
+	return nil
+}
+
+func (post *Post) DropComment(index int) error {
+	if index < 0 || index >= len(post.Comments) {
+		return errors.New(fmt.Sprintf("there is no comment #%d, there are %d comments", index+1, len(post.Comments)))
+	}
+	post.Comments = append(post.Comments[:index], post.Comments[index+1:]...)
+	return nil
+}
+
+// commentIndexByMessage returns index of the comment the admin message belongs to, -1 if there is no such comment
+func (post *Post) commentIndexByMessage(link MessageLink) int {
+	for i, comment := range post.Comments {
+		if indexOfLink(comment.MessagesInChat, link) >= 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// adminMessages returns admin chat messages of the post and all of its comments
+func (post *Post) adminMessages() []MessageLink {
+	links := append([]MessageLink{}, post.MessagesInChat...)
+	for _, comment := range post.Comments {
+		links = append(links, comment.MessagesInChat...)
+	}
+	return links
+}
+
+// Summary is a short description of the post used in lists
+func (post *Post) Summary() string {
+	kind := "text"
+	if len(post.Files) > 0 {
+		kind = fmt.Sprintf("%d files", len(post.Files))
+		if post.AsSources {
+			kind += " as sources"
+		}
+	}
+	text := []rune(post.Text)
+	if len(text) > 32 {
+		text = append(text[:32], []rune("...")...)
+	}
+	return fmt.Sprintf("%s '%s'", kind, string(text))
+}
+
+// Merge appends files and comments of the other post, the text and the schedule of the post are kept
+func (post *Post) Merge(other *Post) {
+	post.Files = append(post.Files, other.Files...)
+	post.MessagesInChat = append(post.MessagesInChat, other.MessagesInChat...)
+	post.Comments = append(post.Comments, other.Comments...)
+	post.AddTags(other.Tags...)
+}
+
+// Split cuts the files starting from the index into a new post, it gets tags and per-post settings of the original,
+// but neither its text nor its comments
+func (post *Post) Split(index int) (*Post, error) {
+	if index <= 0 || index >= len(post.Files) {
+		return nil, errors.New(fmt.Sprintf("the post can't be split after %d files, there are %d files", index, len(post.Files)))
+	}
+	if len(post.MessagesInChat) != len(post.Files) {
+		return nil, errors.New("the post has no message for every file, it can't be split")
+	}
+
+	second := &Post{
+		Id:             fmt.Sprintf("%d_%d", post.MessagesInChat[index].ChatId, post.MessagesInChat[index].MessageId),
+		ScheduledTime:  TimeIsNotSpecified,
+		MessagesInChat: append([]MessageLink{}, post.MessagesInChat[index:]...),
+		AsSources:      post.AsSources,
+		Protected:      post.Protected,
+		Spoiler:        post.Spoiler,
+		Silent:         post.Silent,
+		NoWatermark:    post.NoWatermark,
+		NoPreview:      post.NoPreview,
+		ExpiresAfter:   post.ExpiresAfter,
+		Files:          append([]TgFileInfo{}, post.Files[index:]...),
+		Tags:           append([]string{}, post.Tags...),
+	}
+	post.Files = post.Files[:index]
+	post.MessagesInChat = post.MessagesInChat[:index]
+	return second, nil
 }
 
 func (post *Post) IsDocuments() bool {
@@ -209,28 +450,79 @@ func (post *Post) Clone() *Post {
 }
 
 func (post *Post) Send(bot *ChannelBot, to tele.Recipient) ([]tele.Message, error) {
+	owner := bot.TempFiles.NewOwner(post.Id) // only files of this call are released, the post could be sent concurrently
+	defer bot.TempFiles.ReleaseOwner(owner)
+	defer bot.Media.Release(owner) // converted files are kept until they are uploaded
 	if len(post.Files) == 0 {
-		message, err := bot.Telegram.Send(to, post.Text, post.ToSendOptions())
+		message, err := bot.Sender.Send(to, post.TextWithSource(bot.Config), post.ToSendOptions())
 		if err != nil {
 			return nil, err
 		} else {
 			return []tele.Message{*message}, nil
 		}
-	} else if post.AsSources {
-		album, err := post.ToDocumentsAlbum()
-		if err != nil {
-			return nil, err
-		} else {
-			return bot.Telegram.SendAlbum(to, album, post.ToSendOptions())
-		}
+	}
+
+	var album []tele.Media
+	var err error
+	if post.AsSources {
+		album, err = post.ToDocumentsAlbum()
 	} else {
-		album, err := post.ToAlbum(bot)
-		if err != nil {
-			return nil, err
-		} else {
-			return bot.Telegram.SendAlbum(to, album, post.ToSendOptions())
+		album, err = post.ToAlbum(bot, owner, bot.progressRecipient(to))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	text := post.TextWithSource(bot.Config)
+	caption, rest := splitText(text, MaxCaptionLength)
+	if caption != "" && !captionLast(album, caption) {
+		rest = text
+	}
+	messages, err := sendMediaGroups(bot.Sender, to, splitMediaGroups(album), post.Spoiler, post.ToSendOptions())
+	if err != nil || rest == "" {
+		return messages, err
+	}
+
+	textMessages, err := sendText(bot.Sender, to, rest, post.ToSendOptions())
+	return append(messages, textMessages...), err
+}
+
+// SplitWarning describes how the post is going to be split into several messages, it is empty if no split is needed
+func (post *Post) SplitWarning(cfg Config) string {
+	warnings := []string{}
+	text := post.TextWithSource(cfg)
+
+	kinds := []int{}
+	for _, file := range post.Files {
+		if !post.AsSources || file.Type == TelegramFileTypeDocPhoto || file.Type == TelegramFileTypeDocVideo {
+			kinds = append(kinds, fileMediaGroupKind(file.Type, post.AsSources))
+		}
+	}
+	if sizes := mediaGroupSizes(kinds); len(sizes) > 1 {
+		formatted := make([]string, len(sizes))
+		for i, size := range sizes {
+			formatted[i] = strconv.Itoa(size)
 		}
+		warnings = append(warnings, fmt.Sprintf("files will be sent in %d messages (%s)", len(sizes), strings.Join(formatted, "+")))
 	}
+
+	if len(post.Files) > 0 {
+		if _, rest := splitText(text, MaxCaptionLength); rest != "" {
+			warnings = append(warnings, fmt.Sprintf("text is too long for a caption (%d > %d), %d characters will be sent in a separate message",
+				textLength(text), MaxCaptionLength, textLength(rest)))
+		}
+	}
+	if chunks := len(splitMessageText(text)); chunks > 1 {
+		warnings = append(warnings, fmt.Sprintf("text will be split into %d messages", chunks))
+	}
+
+	for i, comment := range post.Comments {
+		if warning := comment.SplitWarning(cfg); warning != "" {
+			warnings = append(warnings, fmt.Sprintf("comment #%d: %s", i+1, warning))
+		}
+	}
+
+	return strings.Join(warnings, "\n")
 }
 
 func PostFromMessages(messages []*tele.Message) (*Post, error) {
@@ -243,20 +535,29 @@ func PostFromMessages(messages []*tele.Message) (*Post, error) {
 		Protected:      false,
 		Reply:          MessageLink{},
 		Files:          make([]TgFileInfo, len(messages)),
-		Comment:        nil,
+		Source:         SourceFromMessage(messages[0]),
+		Comments:       nil,
 	}
 
 	for i, msg := range messages {
 		post.MessagesInChat[i] = MessageLink{MessageId: msg.ID, ChatId: msg.Chat.ID}
 		switch {
 		case msg.Photo != nil:
-			post.Files[i] = TgFileInfo{TelegramFileTypePhoto, msg.Photo.FileID}
+			post.Files[i] = TgFileInfo{Type: TelegramFileTypePhoto, Id: msg.Photo.FileID, UniqueId: msg.Photo.UniqueID}
 		case msg.Video != nil:
-			post.Files[i] = TgFileInfo{TelegramFileTypeVideo, msg.Video.FileID}
+			post.Files[i] = TgFileInfo{Type: TelegramFileTypeVideo, Id: msg.Video.FileID, UniqueId: msg.Video.UniqueID}
+		case msg.Animation != nil: // has to be checked before the document, telegram fills both for animations
+			post.Files[i] = TgFileInfo{Type: TelegramFileTypeAnimation, Id: msg.Animation.FileID, UniqueId: msg.Animation.UniqueID}
+		case msg.Audio != nil:
+			post.Files[i] = TgFileInfo{Type: TelegramFileTypeAudio, Id: msg.Audio.FileID, UniqueId: msg.Audio.UniqueID}
+		case msg.Voice != nil:
+			post.Files[i] = TgFileInfo{Type: TelegramFileTypeVoice, Id: msg.Voice.FileID, UniqueId: msg.Voice.UniqueID}
+		case msg.Sticker != nil:
+			post.Files[i] = TgFileInfo{Type: TelegramFileTypeSticker, Id: msg.Sticker.FileID, UniqueId: msg.Sticker.UniqueID}
 		case msg.Document != nil && strings.HasPrefix(strings.ToLower(msg.Document.MIME), "image"):
-			post.Files[i] = TgFileInfo{TelegramFileTypeDocPhoto, msg.Document.FileID}
+			post.Files[i] = TgFileInfo{Type: TelegramFileTypeDocPhoto, Id: msg.Document.FileID, UniqueId: msg.Document.UniqueID}
 		case msg.Document != nil && strings.HasPrefix(strings.ToLower(msg.Document.MIME), "video"):
-			post.Files[i] = TgFileInfo{TelegramFileTypeDocVideo, msg.Document.FileID}
+			post.Files[i] = TgFileInfo{Type: TelegramFileTypeDocVideo, Id: msg.Document.FileID, UniqueId: msg.Document.UniqueID}
 		default:
 			return nil, errors.New("message with no supported media is provided")
 		}
@@ -275,6 +576,6 @@ func PostFromText(message *tele.Message) *Post {
 		Protected:      false,
 		Reply:          MessageLink{},
 		Files:          []TgFileInfo{},
-		Comment:        nil,
+		Comments:       nil,
 	}
 }
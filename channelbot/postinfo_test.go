@@ -0,0 +1,102 @@
+package channelbot
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func commentTexts(post *Post) []string {
+	texts := make([]string, len(post.Comments))
+	for i, comment := range post.Comments {
+		texts[i] = comment.Text
+	}
+	return texts
+}
+
+func TestMoveComment(t *testing.T) {
+	tests := []struct {
+		from, to int
+		texts    []string
+		err      bool
+	}{
+		{from: 0, to: 2, texts: []string{"b", "c", "a"}},
+		{from: 2, to: 0, texts: []string{"c", "a", "b"}},
+		{from: 1, to: 2, texts: []string{"a", "c", "b"}},
+		{from: 1, to: 1, texts: []string{"a", "b", "c"}},
+		{from: -1, to: 0, err: true},
+		{from: 0, to: 3, err: true},
+	}
+	for _, test := range tests {
+		post := &Post{Comments: []*Post{{Text: "a"}, {Text: "b"}, {Text: "c"}}}
+		err := post.MoveComment(test.from, test.to)
+		if test.err {
+			if err == nil {
+				t.Errorf("comment #%d is moved to #%d", test.from+1, test.to+1)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(commentTexts(post), test.texts) {
+			t.Errorf("moving #%d to #%d gives %v, %v, want %v", test.from+1, test.to+1, commentTexts(post), err, test.texts)
+		}
+	}
+}
+
+func postWithFiles(n int) *Post {
+	post := &Post{Id: "-1_1", ScheduledTime: "12:00", Tags: []string{"art"}, Protected: true, Text: "text",
+		Spoiler: true, Silent: true, NoWatermark: true, NoPreview: true, ExpiresAfter: time.Hour}
+	for i := 1; i <= n; i++ {
+		post.Files = append(post.Files, TgFileInfo{Type: TelegramFileTypePhoto, Id: fmt.Sprintf("file%d", i)})
+		post.MessagesInChat = append(post.MessagesInChat, MessageLink{ChatId: -1, MessageId: i})
+	}
+	return post
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		files, index int
+		err          string
+	}{
+		{files: 3, index: 1},
+		{files: 3, index: 2},
+		{files: 3, index: 0, err: "after 0 files"},
+		{files: 3, index: 3, err: "after 3 files"},
+		{files: 1, index: 1, err: "after 1 files"},
+	}
+	for _, test := range tests {
+		post := postWithFiles(test.files)
+		second, err := post.Split(test.index)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("splitting %d files after %d gives %v, want an error with '%s'", test.files, test.index, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(post.Files) != test.index || len(post.MessagesInChat) != test.index {
+			t.Errorf("%d files and %d messages are kept, want %d", len(post.Files), len(post.MessagesInChat), test.index)
+		}
+		if len(second.Files) != test.files-test.index || second.Files[0].Id != fmt.Sprintf("file%d", test.index+1) {
+			t.Errorf("the second post got %v", second.Files)
+		}
+		if second.Id != fmt.Sprintf("-1_%d", test.index+1) || second.Text != "" || !second.Protected || !second.Spoiler ||
+			!second.Silent || !second.NoWatermark || !second.NoPreview || second.ExpiresAfter != time.Hour ||
+			second.ScheduledTime != TimeIsNotSpecified || !reflect.DeepEqual(second.Tags, post.Tags) {
+			t.Errorf("the second post is %+v", second)
+		}
+		second.Tags[0] = "changed"
+		if post.Tags[0] != "art" {
+			t.Error("tags are shared by the posts")
+		}
+	}
+
+	post := postWithFiles(3)
+	post.MessagesInChat = post.MessagesInChat[:1]
+	if _, err := post.Split(1); err == nil {
+		t.Error("a post without a message for every file is split")
+	}
+}
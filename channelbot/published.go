@@ -0,0 +1,215 @@
+package channelbot
+
+import (
+	"errors"
+	"fmt"
+	tele "github.com/dontsellfish/telebot_local"
+	"strings"
+	"time"
+)
+
+func (bot *ChannelBot) getReferredPublishedPost(ctx tele.Context) (*Post, error) {
+	if ctx.Message().ReplyTo == nil {
+		return nil, errors.New("no message is provided")
+	}
+	return bot.Database.GetPublishedByMessageLink(MessageLink{MessageId: ctx.Message().ReplyTo.ID, ChatId: ctx.Message().ReplyTo.Chat.ID})
+}
+
+// editPublishedText edits the text of already published post (or its comment) in place
+func (bot *ChannelBot) editPublishedText(post *Post, text string) error {
+	if len(post.Published) == 0 {
+		return errors.New("the post has not been published")
+	}
+
+	edited := *post
+	edited.Text = text
+	oldText, newText := post.TextWithSource(bot.Config), edited.TextWithSource(bot.Config)
+
+	if len(post.Files) == 0 {
+		if len(splitMessageText(oldText)) > 1 || len(splitMessageText(newText)) > 1 {
+			return errors.New("the text is split into several messages, it can't be edited in place")
+		}
+		_, err := bot.Telegram.Edit(post.Published[0], newText, &tele.SendOptions{ParseMode: DefaultParseMode})
+		if err != nil {
+			return err
+		}
+	} else {
+		if _, rest := splitText(oldText, MaxCaptionLength); rest != "" {
+			return errors.New("the caption is split into several messages, it can't be edited in place")
+		}
+		if _, rest := splitText(newText, MaxCaptionLength); rest != "" {
+			return errors.New(fmt.Sprintf("the text is too long for a caption (%d > %d)", textLength(newText), MaxCaptionLength))
+		}
+		index := post.captionIndex()
+		if index < 0 || index >= len(post.Published) {
+			return errors.New("the post has no caption")
+		}
+		_, err := bot.Telegram.EditCaption(post.Published[index], newText, &tele.SendOptions{ParseMode: DefaultParseMode})
+		if err != nil {
+			return err
+		}
+	}
+
+	post.Text = text
+	return nil
+}
+
+// editPublishedMedia replaces the file of already published post (or its comment) with the given one
+func (bot *ChannelBot) editPublishedMedia(post *Post, index int, file TgFileInfo) error {
+	if index >= len(post.Published) {
+		return errors.New("the file has not been published")
+	}
+
+	replacement := &Post{Id: post.Id, Files: []TgFileInfo{file}, AsSources: post.AsSources, NoWatermark: post.NoWatermark}
+	var medias []tele.Media
+	var err error
+	if post.AsSources {
+		medias, err = replacement.ToDocumentsAlbum()
+	} else {
+		owner := bot.TempFiles.NewOwner(post.Id)
+		defer bot.TempFiles.ReleaseOwner(owner)
+		defer bot.Media.Release(owner)
+		medias, err = replacement.ToAlbum(bot, owner, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if len(medias) == 0 {
+		return errors.New("the file can't replace a published one")
+	}
+	if mediaGroupKind(medias[0]) != fileMediaGroupKind(post.Files[index].Type, post.AsSources) {
+		return errors.New("the file has to be of the same kind as the replaced one")
+	}
+	media, ok := medias[0].(tele.Inputtable)
+	if !ok {
+		return errors.New(fmt.Sprintf("media of type %s can't be edited", medias[0].MediaType()))
+	}
+	if index == post.captionIndex() {
+		setCaption(media, post.TextWithSource(bot.Config))
+	}
+
+	_, err = bot.Telegram.EditMedia(post.Published[index], media, &tele.SendOptions{ParseMode: DefaultParseMode})
+	if err != nil {
+		return err
+	}
+
+	post.Files[index] = file
+	return nil
+}
+
+// handlePublishedText is the analogue of the text handler for published posts, only texts could be changed,
+// and only explicitly: with '.p' for the post and '.c' for the comment, so a habitual reply doesn't change the channel
+func (bot *ChannelBot) handlePublishedText(ctx tele.Context, post *Post) error {
+	var err error
+	var report string
+	switch {
+	case strings.HasPrefix(ctx.Text(), "/"):
+		return ctx.Reply("The post is already published, only its texts and files could be edited.")
+	case strings.HasSuffix(ctx.Text(), ".p"):
+		text := tgMessageToMarkdown(ctx.Text()[:len(ctx.Text())-len(".p")], ctx.Message().Entities)
+		report = fmt.Sprintf("Published post text '%s' --> '%s'", post.Text, text)
+		err = bot.editPublishedText(post, text)
+	case strings.HasSuffix(ctx.Text(), ".c"):
+		if len(post.Comments) == 0 {
+			return ctx.Reply("The post has been published without comments, they can't be added.")
+		}
+		index := post.commentIndexByMessage(MessageLink{MessageId: ctx.Message().ReplyTo.ID, ChatId: ctx.Message().ReplyTo.Chat.ID})
+		if index < 0 {
+			index = len(post.Comments) - 1
+		}
+		text := tgMessageToMarkdown(ctx.Text()[:len(ctx.Text())-len(".c")], ctx.Message().Entities)
+		report = fmt.Sprintf("Published comment #%d text '%s' --> '%s'", index+1, post.Comments[index].Text, text)
+		err = bot.editPublishedText(post.Comments[index], text)
+	default:
+		if _, ok := parseTags(ctx.Text()); ok || timeRegex.MatchString(ctx.Text()) {
+			return ctx.Reply("The post is already published, its tags and time can't be changed.")
+		}
+		return ctx.Reply("The post is already published, end the text with '.p' to replace the post text or with '.c' to replace the comment text.")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, _ = bot.Telegram.Reply(ctx.Message(), report)
+	return bot.Database.SetPublished(post)
+}
+
+// handlePublishedMedia replaces the file, which admin message is replied with the new media
+func (bot *ChannelBot) handlePublishedMedia(msgs []*tele.Message, post *Post) error {
+	if len(msgs) != 1 {
+		return errors.New("only a single file could replace a published one")
+	}
+	replacement, err := PostFromMessages(msgs)
+	if err != nil {
+		return err
+	}
+	link := MessageLink{MessageId: msgs[0].ReplyTo.ID, ChatId: msgs[0].Chat.ID}
+
+	target := post
+	index := indexOfLink(post.MessagesInChat, link)
+	if comment := post.commentIndexByMessage(link); index < 0 && comment >= 0 {
+		target = post.Comments[comment]
+		index = indexOfLink(target.MessagesInChat, link)
+	}
+	if index < 0 || index >= len(target.Files) {
+		return errors.New("reply to the message of the file that has to be replaced")
+	}
+
+	err = bot.editPublishedMedia(target, index, replacement.Files[0])
+	if err != nil {
+		return err
+	}
+
+	_, _ = bot.Telegram.Reply(msgs[0], fmt.Sprintf("Published file #%d is replaced.", index+1))
+	return bot.Database.SetPublished(post)
+}
+
+func indexOfLink(links []MessageLink, link MessageLink) int {
+	for i, el := range links {
+		if el == link {
+			return i
+		}
+	}
+	return -1
+}
+
+func (bot *ChannelBot) schedulePublishedDeletion(post *Post) {
+	at := post.DeletionTime(time.Now())
+	if at.IsZero() {
+		return
+	}
+	err := bot.Database.AddJob(&Job{Type: JobDeletePost, PostId: post.Id}, at)
+	if err != nil {
+		bot.alertAdmins("the post won't be deleted at "+at.Format(ExpirationTimeLayout), err.Error())
+	}
+}
+
+// deletePublished deletes the post and its comment from the channel and the comments chat, messages deleted already
+// (e.g. by hand) are fine; if some can't be deleted, the post is kept with only them left, so it could be retried
+func (bot *ChannelBot) deletePublished(post *Post) error {
+	errs := []string{}
+	deleteAll := func(links []MessageLink) []MessageLink {
+		left := []MessageLink{}
+		for _, link := range links {
+			err := bot.Telegram.Delete(link)
+			if err != nil && !errors.Is(err, tele.ErrNotFoundToDelete) {
+				errs = append(errs, fmt.Sprintf("%d/%d: %s", link.ChatId, link.MessageId, err.Error()))
+				left = append(left, link)
+			}
+		}
+		return left
+	}
+	for _, comment := range post.Comments {
+		comment.Published = deleteAll(comment.Published)
+	}
+	post.Published = deleteAll(post.Published)
+
+	if len(errs) == 0 {
+		return bot.Database.RemPublished(post)
+	}
+	err := bot.Database.SetPublished(post)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	return errors.New(strings.Join(errs, "\n"))
+}
@@ -0,0 +1,246 @@
+package channelbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	tele "github.com/dontsellfish/telebot_local"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// telebot doesn't know about some of the Bot API fields yet, requests with them are made here
+
+var rawClient = &http.Client{Timeout: time.Minute}
+
+// rawFloodError mirrors tele.FloodError, which can't be constructed outside of telebot
+type rawFloodError struct {
+	err        *tele.Error
+	RetryAfter int
+}
+
+func (err rawFloodError) Error() string {
+	return err.err.Error()
+}
+
+type spoilerInputMedia struct {
+	tele.InputMedia
+	HasSpoiler bool `json:"has_spoiler,omitempty"`
+}
+
+// rawRequest makes a multipart request, files are given as field name --> local path
+func rawRequest(bot *tele.Bot, method string, params map[string]string, files map[string]string) ([]byte, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for field, filename := range files {
+		err := func() error {
+			file, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			part, err := writer.CreateFormFile(field, path.Base(filename))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(part, file)
+			return err
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for field, value := range params {
+		err := writer.WriteField(field, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := rawClient.Post(bot.URL+"/bot"+bot.Token+"/"+method, writer.FormDataContentType(), body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Ok          bool   `json:"ok"`
+		Code        int    `json:"error_code"`
+		Description string `json:"description"`
+		Parameters  struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		// not an answer of the bot api, e.g. an error page of a proxy, the status tells if it is worth a retry
+		return nil, tele.NewError(resp.StatusCode, fmt.Sprintf("%s: unexpected response %s", method, string(data)))
+	}
+	switch {
+	case result.Ok:
+		return data, nil
+	case result.Code == http.StatusTooManyRequests:
+		return nil, rawFloodError{tele.NewError(result.Code, result.Description), result.Parameters.RetryAfter}
+	case tele.Err(result.Description) != nil:
+		return nil, tele.Err(result.Description)
+	default:
+		return nil, tele.NewError(result.Code, result.Description)
+	}
+}
+
+func rawSendOptions(params map[string]string, opts *tele.SendOptions) {
+	if opts == nil {
+		return
+	}
+	if opts.ReplyTo != nil && opts.ReplyTo.ID != 0 {
+		params["reply_to_message_id"] = strconv.Itoa(opts.ReplyTo.ID)
+	}
+	if opts.AllowWithoutReply {
+		params["allow_sending_without_reply"] = "true"
+	}
+	if opts.DisableNotification {
+		params["disable_notification"] = "true"
+	}
+	if opts.Protected {
+		params["protect_content"] = "true"
+	}
+}
+
+// sendSpoilerAlbum sends photos and videos under a spoiler, a single media is sent by sendPhoto or sendVideo,
+// as albums have to have 2-10 items
+func sendSpoilerAlbum(bot *tele.Bot, to tele.Recipient, group []tele.Media, opts *tele.SendOptions) ([]tele.Message, error) {
+	if len(group) == 1 {
+		message, err := sendSpoilerMedia(bot, to, group[0], opts)
+		if err != nil {
+			return nil, err
+		}
+		return []tele.Message{*message}, nil
+	}
+
+	params := map[string]string{"chat_id": to.Recipient()}
+	rawSendOptions(params, opts)
+
+	files := map[string]string{}
+	media := make([]spoilerInputMedia, len(group))
+	for i, m := range group {
+		im, err := rawInputMedia(m, opts)
+		if err != nil {
+			return nil, err
+		}
+		if im.Media == "" {
+			name := strconv.Itoa(i)
+			im.Media = "attach://" + name
+			files[name] = m.MediaFile().FileLocal
+		}
+		media[i] = spoilerInputMedia{InputMedia: im, HasSpoiler: mediaGroupKind(m) == mediaGroupKindVisual}
+	}
+	buffer, err := json.Marshal(media)
+	if err != nil {
+		return nil, err
+	}
+	params["media"] = string(buffer)
+
+	data, err := rawRequest(bot, "sendMediaGroup", params, files)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Result []tele.Message `json:"result"`
+	}
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Result, nil
+}
+
+// sendSpoilerMedia sends a single photo or video under a spoiler
+func sendSpoilerMedia(bot *tele.Bot, to tele.Recipient, m tele.Media, opts *tele.SendOptions) (*tele.Message, error) {
+	im, err := rawInputMedia(m, opts)
+	if err != nil {
+		return nil, err
+	}
+	if im.Type != "photo" && im.Type != "video" {
+		return nil, errors.New(fmt.Sprintf("media of type %s can't be sent under a spoiler", im.Type))
+	}
+
+	params := map[string]string{"chat_id": to.Recipient(), "has_spoiler": "true"}
+	rawSendOptions(params, opts)
+	files := map[string]string{}
+	if im.Media == "" {
+		files[im.Type] = m.MediaFile().FileLocal
+	} else {
+		params[im.Type] = im.Media
+	}
+	if im.Caption != "" {
+		params["caption"] = im.Caption
+	}
+	if im.ParseMode != "" {
+		params["parse_mode"] = im.ParseMode
+	}
+	if im.Type == "video" {
+		if im.Width > 0 && im.Height > 0 {
+			params["width"], params["height"] = strconv.Itoa(im.Width), strconv.Itoa(im.Height)
+		}
+		if im.Duration > 0 {
+			params["duration"] = strconv.Itoa(im.Duration)
+		}
+		if im.Streaming {
+			params["supports_streaming"] = "true"
+		}
+	}
+
+	method := "sendPhoto"
+	if im.Type == "video" {
+		method = "sendVideo"
+	}
+	data, err := rawRequest(bot, method, params, files)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Result tele.Message `json:"result"`
+	}
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Result, nil
+}
+
+// rawInputMedia describes the media for the raw api, files on disk are left to the caller to attach
+func rawInputMedia(m tele.Media, opts *tele.SendOptions) (tele.InputMedia, error) {
+	inputtable, ok := m.(tele.Inputtable)
+	if !ok {
+		return tele.InputMedia{}, errors.New(fmt.Sprintf("media of type %s can't be in an album", m.MediaType()))
+	}
+	im := inputtable.InputMedia()
+	file := m.MediaFile()
+	switch {
+	case file.InCloud():
+		im.Media = file.FileID
+	case file.FileURL != "":
+		im.Media = file.FileURL
+	case file.OnDisk():
+	default:
+		return tele.InputMedia{}, errors.New("the media file does not exist")
+	}
+	if opts != nil {
+		im.ParseMode = opts.ParseMode
+	}
+	return im, nil
+}
@@ -0,0 +1,111 @@
+package channelbot
+
+import (
+	tele "github.com/dontsellfish/telebot_local"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// apiCall is a request the fake bot api has got
+type apiCall struct {
+	Method string
+	Params map[string]string
+	Files  []string
+}
+
+// fakeBotApi answers every method with success, sendMediaGroup gets two messages, other send* methods and forwards one
+type fakeBotApi struct {
+	Server *httptest.Server
+	Bot    *tele.Bot
+
+	mutex sync.Mutex
+	calls []apiCall
+}
+
+func newFakeBotApi(t *testing.T) *fakeBotApi {
+	api := &fakeBotApi{}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := apiCall{Method: r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:], Params: map[string]string{}}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			_ = r.ParseMultipartForm(1 << 20)
+			for field, values := range r.MultipartForm.Value {
+				call.Params[field] = values[0]
+			}
+			for field := range r.MultipartForm.File {
+				call.Files = append(call.Files, field)
+			}
+		} else {
+			body, _ := io.ReadAll(r.Body)
+			call.Params["body"] = string(body)
+		}
+		api.mutex.Lock()
+		api.calls = append(api.calls, call)
+		api.mutex.Unlock()
+
+		switch {
+		case call.Method == "sendMediaGroup":
+			_, _ = w.Write([]byte(`{"ok":true,"result":[{"message_id":1},{"message_id":2}]}`))
+		case strings.HasPrefix(call.Method, "send"), call.Method == "forwardMessage":
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+		default:
+			_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+		}
+	}))
+	t.Cleanup(api.Server.Close)
+
+	bot, err := tele.NewBot(tele.Settings{Token: "token", URL: api.Server.URL, Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Bot = bot
+	return api
+}
+
+func (api *fakeBotApi) Calls() []apiCall {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	return append([]apiCall{}, api.calls...)
+}
+
+func TestSendSpoilerAlbum(t *testing.T) {
+	api := newFakeBotApi(t)
+	photo := filepath.Join(t.TempDir(), "photo.jpg")
+	writeFile(t, photo, []byte("jpeg"))
+	chat := &tele.Chat{ID: -100}
+
+	single := []tele.Media{&tele.Photo{File: tele.FromDisk(photo), Caption: "caption"}}
+	messages, err := sendSpoilerAlbum(api.Bot, chat, single, &tele.SendOptions{ParseMode: tele.ModeMarkdownV2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("a single photo is sent as %d messages", len(messages))
+	}
+
+	album := []tele.Media{&tele.Photo{File: tele.FromDisk(photo)}, &tele.Video{File: tele.File{FileID: "video"}}}
+	messages, err = sendSpoilerAlbum(api.Bot, chat, album, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("an album of two is sent as %d messages", len(messages))
+	}
+
+	calls := api.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("%d calls are made, want 2", len(calls))
+	}
+	if calls[0].Method != "sendPhoto" || calls[0].Params["has_spoiler"] != "true" || calls[0].Params["caption"] != "caption" ||
+		len(calls[0].Files) != 1 || calls[0].Files[0] != "photo" {
+		t.Errorf("a single photo is sent as %+v", calls[0])
+	}
+	if calls[1].Method != "sendMediaGroup" || strings.Count(calls[1].Params["media"], `"has_spoiler":true`) != 2 ||
+		!strings.Contains(calls[1].Params["media"], `"media":"video"`) || len(calls[1].Files) != 1 {
+		t.Errorf("an album is sent as %+v", calls[1])
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"log"
+	"math/rand"
+	"sort"
 	"strings"
 	"time"
 )
@@ -44,6 +46,12 @@ func (db *Database) SetPost(id string, post *Post) error {
 	if err != nil {
 		return nil
 	}
+	for _, tag := range post.Tags {
+		err = db.addTag(post.Id, tag)
+		if err != nil {
+			return err
+		}
+	}
 	for _, msg := range post.MessagesInChat {
 		err = db.client.Set(redisContext,
 			db.toKey("admin-chat", fmt.Sprintf("%d", msg.ChatId), "msg-id", fmt.Sprintf("%d", msg.MessageId)),
@@ -71,22 +79,52 @@ func (db *Database) EditPost(post *Post) error {
 	original, err := db.GetPost(post.Id)
 	logIfError(err)
 
-	if original.ScheduledTime != post.ScheduledTime {
-		logIfError(db.client.SRem(redisContext, db.toKey("time", original.ScheduledTime), post.Id).Err())
-		size, err := db.client.SCard(redisContext, db.toKey("time", original.ScheduledTime)).Result()
-		logIfError(err)
-		if size == 0 {
-			logIfError(db.client.SRem(redisContext, db.toKey("times"), original.ScheduledTime).Err())
+	if original == nil || original.ScheduledTime != post.ScheduledTime {
+		if original != nil { // it is gone if it has been removed or published meanwhile
+			logIfError(db.client.SRem(redisContext, db.toKey("time", original.ScheduledTime), post.Id).Err())
+			size, err := db.client.SCard(redisContext, db.toKey("time", original.ScheduledTime)).Result()
+			logIfError(err)
+			if size == 0 {
+				logIfError(db.client.SRem(redisContext, db.toKey("times"), original.ScheduledTime).Err())
+			}
 		}
 
 		logIfError(db.client.SAdd(redisContext, db.toKey("times"), post.ScheduledTime).Err())
 		logIfError(db.client.SAdd(redisContext, db.toKey("time", post.ScheduledTime), post.Id).Err())
 	}
 
+	if original != nil {
+		for _, msg := range original.MessagesInChat {
+			if indexOfLink(post.MessagesInChat, msg) < 0 {
+				logIfError(db.client.Del(redisContext,
+					db.toKey("admin-chat", fmt.Sprintf("%d", msg.ChatId), "msg-id", fmt.Sprintf("%d", msg.MessageId))).Err())
+			}
+		}
+	}
+	for _, msg := range post.MessagesInChat {
+		logIfError(db.client.Set(redisContext,
+			db.toKey("admin-chat", fmt.Sprintf("%d", msg.ChatId), "msg-id", fmt.Sprintf("%d", msg.MessageId)),
+			post.Id,
+			0).Err())
+	}
+
+	if original != nil {
+		for _, tag := range original.Tags {
+			if !contains(post.Tags, tag) {
+				logIfError(db.remTag(post.Id, tag))
+			}
+		}
+	}
+	for _, tag := range post.Tags {
+		logIfError(db.addTag(post.Id, tag))
+	}
+
 	b, _ := json.Marshal(post)
 	log.Println("before set", string(b))
 	err = db.client.Set(redisContext, db.toKey("post", post.Id), post, 0).Err()
-	logIfError(err)
+	if err != nil {
+		return err // unlike the indexes above, the post itself has to be saved
+	}
 	post, err = db.GetPost(post.Id)
 	logIfError(err)
 	b, _ = json.Marshal(post)
@@ -106,14 +144,19 @@ func (db *Database) RemPost(post *Post) error {
 	if err != nil {
 		errs = append(errs, err.Error())
 	}
+	for _, tag := range post.Tags {
+		err = db.remTag(post.Id, tag)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
 	err = db.client.Del(redisContext, db.toKey("post", post.Id)).Err()
 	if err != nil {
 		errs = append(errs, err.Error())
 	}
 	for _, msg := range post.MessagesInChat {
 		err = db.client.Del(redisContext,
-			db.toKey("admin-chat", fmt.Sprintf("%d", msg.ChatId), "msg-id", fmt.Sprintf("%d", msg.ChatId)),
-			post.Id).Err()
+			db.toKey("admin-chat", fmt.Sprintf("%d", msg.ChatId), "msg-id", fmt.Sprintf("%d", msg.MessageId))).Err()
 		if err != nil {
 			errs = append(errs, err.Error())
 		}
@@ -146,7 +189,7 @@ func (db *Database) AddComment(id string, comment *Post) error {
 	if err != nil {
 		return err
 	}
-	post.Comment = comment
+	post.AddComment(comment)
 
 	for _, msg := range comment.MessagesInChat {
 		_ = db.AddTemporaryMessageLink(msg, id)
@@ -155,21 +198,253 @@ func (db *Database) AddComment(id string, comment *Post) error {
 	return db.EditPost(post)
 }
 
-func (db *Database) AddRecentlyPosted(id string, idInChannel int) error {
-	_, err := db.GetPost(id)
+// SetPendingComment remembers the published post until its comments are attached, the key is the first message in the channel
+func (db *Database) SetPendingComment(pending *PendingComment) error {
+	return db.client.HSet(redisContext, db.toKey("pending-comments"), fmt.Sprintf("%d", pending.MessageId), pending).Err()
+}
+
+// GetPendingComment finds the post by the message in the channel, if it is not the first message of the post
+// (e.g. the forwards of an album are split), the other messages of pending posts are looked through
+func (db *Database) GetPendingComment(idInChannel int) (*PendingComment, error) {
+	field, err := db.client.HGet(redisContext, db.toKey("pending-comments"), fmt.Sprintf("%d", idInChannel)).Result()
+	if err == nil {
+		pending := &PendingComment{}
+		return pending, json.Unmarshal([]byte(field), pending)
+	}
+	if !IsErrRedisNotFound(err) {
+		return nil, err
+	}
+
+	pendings, err := db.GetPendingComments()
+	if err != nil {
+		return nil, err
+	}
+	for _, pending := range pendings {
+		for _, link := range pending.Published {
+			if link.MessageId == idInChannel {
+				return pending, nil
+			}
+		}
+	}
+	return nil, redis.Nil
+}
+
+func (db *Database) GetPendingComments() ([]*PendingComment, error) {
+	fields, err := db.client.HGetAll(redisContext, db.toKey("pending-comments")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pendings := make([]*PendingComment, 0, len(fields))
+	for _, field := range fields {
+		pending := &PendingComment{}
+		err = json.Unmarshal([]byte(field), pending)
+		if err != nil {
+			return nil, err
+		}
+		pendings = append(pendings, pending)
+	}
+	return pendings, nil
+}
+
+func (db *Database) RemPendingComment(pending *PendingComment) error {
+	return db.client.HDel(redisContext, db.toKey("pending-comments"), fmt.Sprintf("%d", pending.MessageId)).Err()
+}
+
+// SetPublished saves the post after it has been posted, so it could be found by messages in admin chats and edited
+func (db *Database) SetPublished(post *Post) error {
+	links := post.adminMessages()
+	for _, msg := range links {
+		err := db.client.Set(redisContext,
+			db.toKey("admin-chat", fmt.Sprintf("%d", msg.ChatId), "published-msg-id", fmt.Sprintf("%d", msg.MessageId)),
+			post.Id,
+			0).Err()
+		if err != nil {
+			return err
+		}
+	}
+	for _, msg := range post.Published {
+		err := db.client.Set(redisContext, db.toKey("channel", "published-msg-id", fmt.Sprintf("%d", msg.MessageId)), post.Id, 0).Err()
+		if err != nil {
+			return err
+		}
+	}
+	err := db.client.SAdd(redisContext, db.toKey("published"), post.Id).Err()
+	if err != nil {
+		return err
+	}
+	return db.client.Set(redisContext, db.toKey("published", post.Id), post, 0).Err()
+}
+
+func (db *Database) GetPublished(id string) (*Post, error) {
+	buffer, err := db.client.Get(redisContext, db.toKey("published", id)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var post Post
+	err = json.Unmarshal(buffer, &post)
+	if err != nil {
+		return nil, err
+	}
+
+	return &post, nil
+}
+
+func (db *Database) GetPublishedByMessageLink(link MessageLink) (*Post, error) {
+	id, err := db.client.Get(redisContext,
+		db.toKey("admin-chat", fmt.Sprintf("%d", link.ChatId), "published-msg-id", fmt.Sprintf("%d", link.MessageId))).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return db.GetPublished(id)
+}
+
+// GetPublishedByChannelMessage finds the published post by any of its messages in the channel
+func (db *Database) GetPublishedByChannelMessage(idInChannel int) (*Post, error) {
+	id, err := db.client.Get(redisContext, db.toKey("channel", "published-msg-id", fmt.Sprintf("%d", idInChannel))).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return db.GetPublished(id)
+}
+
+// RemPublished forgets the published post, it could not be edited afterwards
+func (db *Database) RemPublished(post *Post) error {
+	links := post.adminMessages()
+	for _, msg := range links {
+		err := db.client.Del(redisContext,
+			db.toKey("admin-chat", fmt.Sprintf("%d", msg.ChatId), "published-msg-id", fmt.Sprintf("%d", msg.MessageId))).Err()
+		if err != nil {
+			return err
+		}
+	}
+	for _, msg := range post.Published {
+		err := db.client.Del(redisContext, db.toKey("channel", "published-msg-id", fmt.Sprintf("%d", msg.MessageId))).Err()
+		if err != nil {
+			return err
+		}
+	}
+	err := db.client.SRem(redisContext, db.toKey("published"), post.Id).Err()
 	if err != nil {
 		return err
 	}
-	return db.client.Set(redisContext, db.toKey("recent", fmt.Sprintf("%d", idInChannel)), id, time.Minute).Err()
+	return db.client.Del(redisContext, db.toKey("published", post.Id)).Err()
+}
+
+// ClaimPost marks the post as being published, false is returned if it has been claimed already,
+// the claim expires by itself, so a crash right after claiming doesn't lock the post forever
+func (db *Database) ClaimPost(id string) (bool, error) {
+	return db.client.SetNX(redisContext, db.toKey("publishing", id), time.Now().Unix(), PublishClaimTimeout).Result()
+}
+
+func (db *Database) ReleasePost(id string) error {
+	return db.client.Del(redisContext, db.toKey("publishing", id)).Err()
+}
+
+// SetFailed moves the post to the quarantine, it has to be removed from the queue separately
+func (db *Database) SetFailed(post *Post) error {
+	return db.client.HSet(redisContext, db.toKey("failed"), post.Id, post).Err()
 }
 
-func (db *Database) GetRecentlyPosted(idInChannel int) (*Post, error) {
-	id, err := db.client.Get(redisContext, db.toKey("recent", fmt.Sprintf("%d", idInChannel))).Bytes()
+// GetFailed returns quarantined posts sorted by their ids
+func (db *Database) GetFailed() ([]*Post, error) {
+	fields, err := db.client.HGetAll(redisContext, db.toKey("failed")).Result()
 	if err != nil {
 		return nil, err
 	}
 
-	return db.GetPost(string(id))
+	posts := make([]*Post, 0, len(fields))
+	for _, field := range fields {
+		post := &Post{}
+		err = json.Unmarshal([]byte(field), post)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].Id < posts[j].Id
+	})
+	return posts, nil
+}
+
+func (db *Database) RemFailed(post *Post) error {
+	return db.client.HDel(redisContext, db.toKey("failed"), post.Id).Err()
+}
+
+func (db *Database) AddJob(job *Job, at time.Time) error {
+	return db.client.ZAdd(redisContext, db.toKey("jobs"), &redis.Z{Score: float64(at.Unix()), Member: job}).Err()
+}
+
+func (db *Database) GetDueJobs(now time.Time) ([]*Job, error) {
+	members, err := db.client.ZRangeByScore(redisContext, db.toKey("jobs"), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprintf("%d", now.Unix()),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, len(members))
+	for i, member := range members {
+		jobs[i] = &Job{}
+		err = json.Unmarshal([]byte(member), jobs[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+func (db *Database) RemJob(job *Job) error {
+	return db.client.ZRem(redisContext, db.toKey("jobs"), job).Err()
+}
+
+// SetPendingMerge remembers the post other posts are going to be merged into
+func (db *Database) SetPendingMerge(chatId int64, id string) error {
+	return db.client.Set(redisContext, db.toKey("merge", fmt.Sprintf("%d", chatId)), id, time.Minute*10).Err()
+}
+
+func (db *Database) PopPendingMerge(chatId int64) (*Post, error) {
+	key := db.toKey("merge", fmt.Sprintf("%d", chatId))
+	id, err := db.client.Get(redisContext, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	err = db.client.Del(redisContext, key).Err()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetPost(id)
+}
+
+func (db *Database) SetMediaRecord(uniqueId string, record *MediaRecord) error {
+	return db.client.HSet(redisContext, db.toKey("media"), uniqueId, record).Err()
+}
+
+func (db *Database) RemMediaRecord(uniqueId string) error {
+	return db.client.HDel(redisContext, db.toKey("media"), uniqueId).Err()
+}
+
+// GetMediaRecords returns records of all files ever queued, file_unique_id --> record
+func (db *Database) GetMediaRecords() (map[string]*MediaRecord, error) {
+	fields, err := db.client.HGetAll(redisContext, db.toKey("media")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]*MediaRecord, len(fields))
+	for uniqueId, field := range fields {
+		records[uniqueId] = &MediaRecord{}
+		err = json.Unmarshal([]byte(field), records[uniqueId])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
 }
 
 func (db *Database) AddTemporaryMessageLink(link MessageLink, id string) error {
@@ -189,12 +464,69 @@ func (db *Database) GetPostByMessageLink(link MessageLink) (*Post, error) {
 	return db.GetPost(id)
 }
 
-func (db *Database) GetRandomPostByTime(t string) (*Post, error) {
-	id, err := db.client.SRandMember(redisContext, db.toKey("time", t)).Bytes()
+func (db *Database) addTag(id string, tag string) error {
+	err := db.client.SAdd(redisContext, db.toKey("tags"), tag).Err()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	return db.client.SAdd(redisContext, db.toKey("tag", tag), id).Err()
+}
+
+func (db *Database) remTag(id string, tag string) error {
+	err := db.client.SRem(redisContext, db.toKey("tag", tag), id).Err()
+	if err != nil {
+		return err
+	}
+	size, err := db.client.SCard(redisContext, db.toKey("tag", tag)).Result()
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return db.client.SRem(redisContext, db.toKey("tags"), tag).Err()
 	}
-	buffer, err := db.client.Get(redisContext, db.toKey("post", string(id))).Bytes()
+	return nil
+}
+
+// GetRandomPostByTime picks a random post scheduled for the time, if tags are given, only posts with any of them are considered
+func (db *Database) GetRandomPostByTime(t string, tags ...string) (*Post, error) {
+	return db.GetRandomPostByTimeExcept(t, tags, nil)
+}
+
+// GetRandomPostByTimeExcept is GetRandomPostByTime, which never picks the excluded posts
+func (db *Database) GetRandomPostByTimeExcept(t string, tags []string, excluded []string) (*Post, error) {
+	var id string
+	if len(tags) == 0 && len(excluded) == 0 {
+		member, err := db.client.SRandMember(redisContext, db.toKey("time", t)).Result()
+		if err != nil {
+			return nil, err
+		}
+		id = member
+	} else {
+		candidates := []string{}
+		sets := [][]string{}
+		if len(tags) == 0 {
+			sets = append(sets, []string{db.toKey("time", t)})
+		}
+		for _, tag := range tags {
+			sets = append(sets, []string{db.toKey("time", t), db.toKey("tag", normalizeTag(tag))})
+		}
+		for _, keys := range sets {
+			ids, err := db.client.SInter(redisContext, keys...).Result()
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				if !contains(candidates, id) && !contains(excluded, id) {
+					candidates = append(candidates, id)
+				}
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, redis.Nil
+		}
+		id = candidates[rand.Intn(len(candidates))]
+	}
+	buffer, err := db.client.Get(redisContext, db.toKey("post", id)).Bytes()
 	if err != nil {
 		return nil, err
 	}
@@ -249,6 +581,22 @@ func (db *Database) Report() (string, error) {
 		totalSize += size
 	}
 
+	tags, err := db.client.SMembers(redisContext, db.toKey("tags")).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(tags) > 0 {
+		sort.Strings(tags)
+		report = append(report, "")
+		for _, tag := range tags {
+			size, err := db.client.SCard(redisContext, db.toKey("tag", tag)).Result()
+			if err != nil {
+				return "", err
+			}
+			report = append(report, fmt.Sprintf("#%s  -  %d", tag, size))
+		}
+	}
+
 	return strings.Join(report, "\n"), nil
 }
 
@@ -0,0 +1,181 @@
+package channelbot
+
+import (
+	"encoding/json"
+	"errors"
+	tele "github.com/dontsellfish/telebot_local"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultGlobalRate = 25        // requests per second
+	DefaultChatRate   = 1         // requests per second to a private chat
+	DefaultGroupRate  = 20.0 / 60 // requests per second to a group or a channel
+	DefaultMaxRetries = 5
+
+	retryBaseDelay = time.Second
+	retryMaxDelay  = time.Second * 30
+)
+
+// RateLimits keeps the bot under telegram's flood limits, the defaults are the limits from the bot api faq
+type RateLimits struct {
+	Global     float64 `json:"global,omitempty"`
+	Chat       float64 `json:"chat,omitempty"`
+	Group      float64 `json:"group,omitempty"`
+	MaxRetries int     `json:"max-retries,omitempty"`
+}
+
+// Sender sends messages within the rate budget, flood waits and transient errors are retried after a delay
+type Sender struct {
+	Telegram *tele.Bot
+	Limits   RateLimits
+
+	mutex sync.Mutex
+	next  time.Time            // the next request to the api could be made then
+	chats map[string]time.Time // the same for every chat
+}
+
+func NewSender(bot *tele.Bot, limits RateLimits) *Sender {
+	if limits.Global <= 0 {
+		limits.Global = DefaultGlobalRate
+	}
+	if limits.Chat <= 0 {
+		limits.Chat = DefaultChatRate
+	}
+	if limits.Group <= 0 {
+		limits.Group = DefaultGroupRate
+	}
+	if limits.MaxRetries <= 0 {
+		limits.MaxRetries = DefaultMaxRetries
+	}
+	return &Sender{Telegram: bot, Limits: limits, chats: map[string]time.Time{}}
+}
+
+func rateInterval(rate float64) time.Duration {
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// reserve returns when the request to the chat could be made, the slot is taken at once
+func (sender *Sender) reserve(chat string) time.Time {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+
+	at := time.Now()
+	if sender.next.After(at) {
+		at = sender.next
+	}
+	if next := sender.chats[chat]; next.After(at) {
+		at = next
+	}
+	sender.next = at.Add(rateInterval(sender.Limits.Global))
+	if strings.HasPrefix(chat, "-") {
+		sender.chats[chat] = at.Add(rateInterval(sender.Limits.Group))
+	} else {
+		sender.chats[chat] = at.Add(rateInterval(sender.Limits.Chat))
+	}
+	return at
+}
+
+// pause makes the chat wait at least for the duration, e.g. after a flood wait
+func (sender *Sender) pause(chat string, duration time.Duration) {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	if until := time.Now().Add(duration); until.After(sender.chats[chat]) {
+		sender.chats[chat] = until
+	}
+}
+
+// telebot turns api errors it doesn't know into plain strings like "telegram: Bad Gateway (502)"
+var telebotErrorRegex = regexp.MustCompile(`^telegram: .*\((\d+)\)$`)
+
+// apiErrorCode returns the error code of a bot api error, whether it has come from telebot or rawRequest, 0 otherwise
+func apiErrorCode(err error) int {
+	var apiErr *tele.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	if err == nil {
+		return 0
+	}
+	if match := telebotErrorRegex.FindStringSubmatch(err.Error()); match != nil {
+		code, _ := strconv.Atoi(match[1])
+		return code
+	}
+	return 0
+}
+
+// retryDelay tells if the error is worth another attempt and when, flood waits come with their own delay;
+// sends are not idempotent, so only errors which guarantee that nothing has been sent are retried: rejections
+// by telegram, failures to connect and non-json answers, which are error pages of a proxy or of the api gateway,
+// a timeout of a request that has been written might have posted already
+func retryDelay(err error, attempt int) (time.Duration, bool) {
+	var flood tele.FloodError
+	var rawFlood rawFloodError
+	var syntaxErr *json.SyntaxError
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &flood):
+		return time.Duration(flood.RetryAfter)*time.Second + time.Second, true
+	case errors.As(err, &rawFlood):
+		return time.Duration(rawFlood.RetryAfter)*time.Second + time.Second, true
+	case apiErrorCode(err) == http.StatusTooManyRequests, apiErrorCode(err) >= 500,
+		errors.As(err, &syntaxErr),
+		errors.As(err, &opErr) && opErr.Op == "dial",
+		errors.As(err, &dnsErr):
+		delay := retryBaseDelay << attempt
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+		return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)), true
+	default:
+		return 0, false
+	}
+}
+
+func (sender *Sender) do(to tele.Recipient, call func() error) error {
+	chat := to.Recipient()
+	for attempt := 0; ; attempt++ {
+		time.Sleep(time.Until(sender.reserve(chat)))
+		err := call()
+		delay, retry := retryDelay(err, attempt)
+		if err == nil || !retry || attempt >= sender.Limits.MaxRetries {
+			return err
+		}
+		sender.pause(chat, delay)
+	}
+}
+
+func (sender *Sender) Send(to tele.Recipient, what interface{}, opts ...interface{}) (*tele.Message, error) {
+	var message *tele.Message
+	err := sender.do(to, func() (err error) {
+		message, err = sender.Telegram.Send(to, what, opts...)
+		return err
+	})
+	return message, err
+}
+
+func (sender *Sender) SendAlbum(to tele.Recipient, album tele.Album, opts ...interface{}) ([]tele.Message, error) {
+	var messages []tele.Message
+	err := sender.do(to, func() (err error) {
+		messages, err = sender.Telegram.SendAlbum(to, album, opts...)
+		return err
+	})
+	return messages, err
+}
+
+func (sender *Sender) SendSpoilerAlbum(to tele.Recipient, group []tele.Media, opts *tele.SendOptions) ([]tele.Message, error) {
+	var messages []tele.Message
+	err := sender.do(to, func() (err error) {
+		messages, err = sendSpoilerAlbum(sender.Telegram, to, group, opts)
+		return err
+	})
+	return messages, err
+}
@@ -0,0 +1,98 @@
+package channelbot
+
+import (
+	"errors"
+	"fmt"
+	tele "github.com/dontsellfish/telebot_local"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryDelay(t *testing.T) {
+	request := func(err error) error {
+		return fmt.Errorf("telebot: %w", &url.Error{Op: "Post", URL: "https://api.telegram.org", Err: err})
+	}
+	tests := []struct {
+		name     string
+		err      error
+		attempt  int
+		retry    bool
+		min, max time.Duration
+	}{
+		{name: "success", err: nil},
+		{name: "flood", err: tele.FloodError{RetryAfter: 5}, retry: true, min: time.Second * 6, max: time.Second * 6},
+		{name: "raw flood", err: rawFloodError{RetryAfter: 3}, retry: true, min: time.Second * 4, max: time.Second * 4},
+		{name: "too many requests", err: &tele.Error{Code: 429}, retry: true, min: retryBaseDelay / 2, max: retryBaseDelay},
+		{name: "bad gateway", err: &tele.Error{Code: 502}, attempt: 2, retry: true, min: retryBaseDelay * 2, max: retryBaseDelay * 4},
+		{name: "bad request", err: &tele.Error{Code: 400}},
+		{name: "forbidden", err: &tele.Error{Code: 403}},
+		{name: "dial", err: request(&net.OpError{Op: "dial", Err: errors.New("connection refused")}), retry: true,
+			min: retryBaseDelay / 2, max: retryBaseDelay},
+		{name: "dns", err: request(&net.DNSError{Err: "no such host"}), retry: true, min: retryBaseDelay / 2, max: retryBaseDelay},
+		{name: "capped", err: &tele.Error{Code: 500}, attempt: 20, retry: true, min: retryMaxDelay / 2, max: retryMaxDelay},
+		{name: "read", err: request(&net.OpError{Op: "read", Err: errors.New("connection reset by peer")})},
+		{name: "timeout", err: request(timeoutError{})},
+		{name: "unknown", err: errors.New("something")},
+	}
+	for _, test := range tests {
+		delay, retry := retryDelay(test.err, test.attempt)
+		if retry != test.retry {
+			t.Errorf("%s: retry is %t", test.name, retry)
+		}
+		if retry && (delay < test.min || delay > test.max) {
+			t.Errorf("%s: the delay %s is not within [%s, %s]", test.name, delay, test.min, test.max)
+		}
+	}
+}
+
+func TestRetryDelayResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		retry  bool
+	}{
+		{name: "bad gateway", status: 502, body: `{"ok":false,"error_code":502,"description":"Bad Gateway"}`, retry: true},
+		{name: "proxy page", status: 502, body: "<html><body><h1>502 Bad Gateway</h1></body></html>", retry: true},
+		{name: "unavailable", status: 503, body: "", retry: true},
+		{name: "too many requests", status: 429, retry: true,
+			body: `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`},
+		{name: "bad request", status: 400, body: `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`},
+		{name: "forbidden", status: 403, body: `{"ok":false,"error_code":403,"description":"Forbidden: bot was kicked from the channel chat"}`},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			_, _ = w.Write([]byte(test.body))
+		}))
+		bot, err := tele.NewBot(tele.Settings{Token: "test", URL: server.URL, Offline: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = bot.Send(&tele.Chat{ID: 1}, "text")
+		if err == nil {
+			t.Errorf("%s: telebot: no error", test.name)
+		} else if _, retry := retryDelay(err, 0); retry != test.retry {
+			t.Errorf("%s: telebot: retry is %t for %q", test.name, retry, err.Error())
+		}
+
+		_, err = rawRequest(bot, "sendMessage", map[string]string{"chat_id": "1", "text": "text"}, nil)
+		if err == nil {
+			t.Errorf("%s: raw: no error", test.name)
+		} else if _, retry := retryDelay(err, 0); retry != test.retry {
+			t.Errorf("%s: raw: retry is %t for %q", test.name, retry, err.Error())
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,106 @@
+package channelbot
+
+import (
+	"fmt"
+	tele "github.com/dontsellfish/telebot_local"
+	"strings"
+)
+
+const (
+	SourcePlacementCaption = "caption"
+	SourcePlacementComment = "comment"
+	SourcePlacementNone    = "none"
+)
+
+// SourceAttribution is the origin of a forwarded post
+type SourceAttribution struct {
+	ChatId    int64  `json:"chat-id,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Username  string `json:"username,omitempty"`
+	MessageId int    `json:"message-id,omitempty"`
+	Link      string `json:"link,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Hidden    bool   `json:"hidden,omitempty"` // the original sender hides their account, only the name is known
+}
+
+// SourceFromMessage returns the origin of the forwarded message, nil if it is not forwarded
+func SourceFromMessage(msg *tele.Message) *SourceAttribution {
+	switch {
+	case msg.OriginalChat != nil:
+		source := &SourceAttribution{
+			ChatId:    msg.OriginalChat.ID,
+			Title:     msg.OriginalChat.Title,
+			Username:  msg.OriginalChat.Username,
+			MessageId: msg.OriginalMessageID,
+			Signature: msg.OriginalSignature,
+		}
+		switch {
+		case source.Username != "" && source.MessageId != 0:
+			source.Link = fmt.Sprintf("https://t.me/%s/%d", source.Username, source.MessageId)
+		case source.Username != "":
+			source.Link = "https://t.me/" + source.Username
+		default:
+			source.Link = MessageLink{ChatId: source.ChatId, MessageId: source.MessageId}.URL()
+		}
+		return source
+	case msg.OriginalSender != nil:
+		source := &SourceAttribution{
+			ChatId:   msg.OriginalSender.ID,
+			Title:    strings.TrimSpace(msg.OriginalSender.FirstName + " " + msg.OriginalSender.LastName),
+			Username: msg.OriginalSender.Username,
+		}
+		if source.Username != "" {
+			source.Link = "https://t.me/" + source.Username
+		}
+		return source
+	case msg.OriginalSenderName != "":
+		return &SourceAttribution{Title: msg.OriginalSenderName, Hidden: true}
+	default:
+		return nil
+	}
+}
+
+// Render formats the attribution as markdown, {title}, {username}, {link} and {signature} are replaced,
+// if there is no link, just the title is returned
+func (source *SourceAttribution) Render(format string) string {
+	if source.Link == "" {
+		return escapeTgMarkdownV2SpecialSymbols(source.Title)
+	}
+	username := ""
+	if source.Username != "" {
+		username = "@" + source.Username
+	}
+	return strings.NewReplacer(
+		"{title}", escapeTgMarkdownV2SpecialSymbols(source.Title),
+		"{username}", escapeTgMarkdownV2SpecialSymbols(username),
+		"{link}", escapeTgMarkdownV2SpecialSymbols(source.Link),
+		"{signature}", escapeTgMarkdownV2SpecialSymbols(source.Signature),
+	).Replace(format)
+}
+
+// TextWithSource returns the text of the post to be sent, with the attribution if it has to be in the caption
+func (post *Post) TextWithSource(cfg Config) string {
+	if post.Source == nil || cfg.SourcePlacement != SourcePlacementCaption {
+		return post.Text
+	}
+	if post.Text == "" {
+		return post.Source.Render(cfg.SourceFormat)
+	}
+	return post.Text + "\n\n" + post.Source.Render(cfg.SourceFormat)
+}
+
+// SourceComment returns a text comment with the attribution if it has to be in the comments, nil otherwise
+func (post *Post) SourceComment(cfg Config) *Post {
+	if post.Source == nil || cfg.SourcePlacement != SourcePlacementComment {
+		return nil
+	}
+	return &Post{
+		Id:            post.Id + "_source",
+		ScheduledTime: TimeIsNotSpecified,
+		Text:          post.Source.Render(cfg.SourceFormat),
+		Protected:     post.Protected,
+		Silent:        post.Silent,
+		NoPreview:     post.NoPreview,
+		Files:         []TgFileInfo{},
+	}
+}
@@ -0,0 +1,207 @@
+package channelbot
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultTemporaryFilesQuota = 2_000_000_000 // bytes
+	TemporaryFilesSubdirectory = "tmp"
+)
+
+// TempFiles is the only place temporary files are created in, every file has an owner (e.g. a post id),
+// the directory belongs to the manager entirely, so anything left there after a restart is removed;
+// every file gets a directory of its own, so files made from it (e.g. converted copies) are kept next to it
+type TempFiles struct {
+	Directory string
+	Quota     int64
+
+	mutex  sync.Mutex
+	files  map[string]*tempFile
+	owners int
+}
+
+type tempFile struct {
+	owner    string
+	reserved int64
+}
+
+func NewTempFiles(directory string, quota int64) (*TempFiles, error) {
+	if quota <= 0 {
+		quota = DefaultTemporaryFilesQuota
+	}
+	err := createDirectoryIfNotFound(directory)
+	if err != nil {
+		return nil, err
+	}
+	return &TempFiles{Directory: directory, Quota: quota, files: map[string]*tempFile{}}, nil
+}
+
+// NewOwner returns a unique owner name based on the given one, so files of concurrent jobs
+// for the same post (e.g. a preview while it is being published) are released separately
+func (temp *TempFiles) NewOwner(base string) string {
+	temp.mutex.Lock()
+	defer temp.mutex.Unlock()
+	temp.owners++
+	return fmt.Sprintf("%s#%d", base, temp.owners)
+}
+
+// Create makes an empty file with a unique name, size is how much it is expected to take,
+// if it doesn't fit the quota, an error is returned
+func (temp *TempFiles) Create(owner string, size int64) (string, error) {
+	if owner == "" {
+		owner = "bot"
+	}
+	temp.mutex.Lock()
+	defer temp.mutex.Unlock()
+
+	usage := temp.usage()
+	if usage+size > temp.Quota {
+		return "", errors.New(fmt.Sprintf("no space for temporary files: %d + %d > %d bytes", usage, size, temp.Quota))
+	}
+
+	directory, err := os.MkdirTemp(temp.Directory, strings.ReplaceAll(owner, string(os.PathSeparator), "_")+"-*")
+	if err != nil {
+		return "", err
+	}
+	filename := filepath.Join(directory, "file")
+	file, err := os.Create(filename)
+	if err != nil {
+		_ = os.RemoveAll(directory)
+		return "", err
+	}
+	_ = file.Close()
+	temp.files[filename] = &tempFile{owner: owner, reserved: size}
+	return filename, nil
+}
+
+// Release removes the file and everything made from it in its directory
+func (temp *TempFiles) Release(filename string) {
+	temp.mutex.Lock()
+	defer temp.mutex.Unlock()
+	temp.release(filename)
+}
+
+func (temp *TempFiles) release(filename string) {
+	if _, ok := temp.files[filename]; !ok {
+		return
+	}
+	_ = os.RemoveAll(filepath.Dir(filename))
+	delete(temp.files, filename)
+}
+
+func (temp *TempFiles) ReleaseOwner(owner string) {
+	temp.mutex.Lock()
+	defer temp.mutex.Unlock()
+	for filename, file := range temp.files {
+		if file.owner == owner {
+			temp.release(filename)
+		}
+	}
+}
+
+// Sweep removes every file the manager doesn't know about, it is meant to be called on startup
+func (temp *TempFiles) Sweep() (int, error) {
+	temp.mutex.Lock()
+	defer temp.mutex.Unlock()
+	entries, err := os.ReadDir(temp.Directory)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		name := filepath.Join(temp.Directory, entry.Name())
+		if temp.isTracked(name) {
+			continue
+		}
+		if os.RemoveAll(name) == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (temp *TempFiles) isTracked(directory string) bool {
+	for filename := range temp.files {
+		if filepath.Dir(filename) == directory {
+			return true
+		}
+	}
+	return false
+}
+
+// usage is the size of the directory, files which are still being written count as their expected size
+func (temp *TempFiles) usage() int64 {
+	usage := int64(0)
+	_ = filepath.WalkDir(temp.Directory, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		size := info.Size()
+		if file, ok := temp.files[name]; ok && file.reserved > size {
+			size = file.reserved
+		}
+		usage += size
+		return nil
+	})
+	return usage
+}
+
+func (temp *TempFiles) Status() string {
+	temp.mutex.Lock()
+	defer temp.mutex.Unlock()
+	owners := map[string]int{}
+	for _, file := range temp.files {
+		owners[file.owner]++
+	}
+	names := []string{}
+	for owner, count := range owners {
+		names = append(names, fmt.Sprintf("%s (%d)", owner, count))
+	}
+	sort.Strings(names)
+
+	status := fmt.Sprintf("Temporary files: %d, %.1f/%.1f MB", len(temp.files), float64(temp.usage())/1e6, float64(temp.Quota)/1e6)
+	if len(names) > 0 {
+		status += "\nOwners: " + strings.Join(names, ", ")
+	}
+	return status
+}
+
+// downloadTemporary downloads the file as a temporary one of the owner, it has to be released afterwards
+func (bot *ChannelBot) downloadTemporary(owner string, fileId string) (string, error) {
+	file, err := bot.Telegram.FileByID(fileId)
+	if err != nil {
+		return "", err
+	}
+	filename, err := bot.TempFiles.Create(owner, file.FileSize)
+	if err != nil {
+		return "", err
+	}
+	err = bot.Telegram.Download(&file, filename)
+	if err != nil {
+		bot.TempFiles.Release(filename)
+		return "", err
+	}
+	return filename, nil
+}
+
+func (bot *ChannelBot) sweepTemporaryFiles() {
+	removed, err := bot.TempFiles.Sweep()
+	if err != nil {
+		bot.alertAdmins("WHILE SWEEPING TEMPORARY FILES", err.Error())
+	} else if removed > 0 {
+		log.Printf("%d stale temporary files are removed", removed)
+	}
+}
@@ -0,0 +1,82 @@
+package channelbot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+func TestTempFilesRelease(t *testing.T) {
+	temp, err := NewTempFiles(t.TempDir(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := temp.Create("post", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := temp.Create("post", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived := first + ".jpg"
+	writeFile(t, derived, []byte("converted"))
+
+	temp.Release(first)
+	if exists(first) || exists(derived) {
+		t.Error("the released file or its derived one is left")
+	}
+	if !exists(second) {
+		t.Error("another file of the same owner is removed")
+	}
+
+	_, err = temp.Create("post", 2000)
+	if err == nil {
+		t.Error("a file over the quota is created")
+	}
+}
+
+func TestTempFilesOwners(t *testing.T) {
+	temp, err := NewTempFiles(t.TempDir(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishing, preview := temp.NewOwner("post"), temp.NewOwner("post")
+	if publishing == preview {
+		t.Fatalf("owners are the same %s", publishing)
+	}
+	published, _ := temp.Create(publishing, 0)
+	previewed, _ := temp.Create(preview, 0)
+
+	temp.ReleaseOwner(publishing)
+	if exists(published) {
+		t.Error("a file of the released owner is left")
+	}
+	if !exists(previewed) {
+		t.Error("a file of another owner is removed")
+	}
+}
+
+func TestTempFilesSweep(t *testing.T) {
+	directory := t.TempDir()
+	stale := filepath.Join(directory, "stale")
+	writeFile(t, stale, []byte("left after a restart"))
+
+	temp, err := NewTempFiles(directory, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked, _ := temp.Create("post", 0)
+	removed, err := temp.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || exists(stale) || !exists(tracked) {
+		t.Errorf("removed %d, the stale file exists %t, the tracked one exists %t", removed, exists(stale), exists(tracked))
+	}
+}
@@ -6,17 +6,32 @@ import (
 	"fmt"
 	tele "github.com/dontsellfish/telebot_local"
 	"github.com/go-redis/redis/v8"
+	"log"
 	"os"
+	"os/signal"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// timeRegex matches schedule slots, e.g. 09:30
+var timeRegex = regexp.MustCompile("^([0-1][0-9]|2[0-3]):[0-5][0-9]$")
+
 type ChannelBot struct {
 	Telegram  *tele.Bot
 	Config    Config
 	Database  *Database
 	Converter *Converter
+	Media     *MediaJobs
+	TempFiles *TempFiles
+	Sender    *Sender
+
+	shutdown chan struct{}
+	comments sync.Mutex // the forward to the comments chat and the end of publishing race to attach comments
 }
 
 func FromFile(filename string) (*ChannelBot, error) {
@@ -28,11 +43,24 @@ func FromFile(filename string) (*ChannelBot, error) {
 }
 
 func New(config Config) (bot *ChannelBot, err error) {
-	bot = &ChannelBot{Telegram: nil, Config: config.FillDefaults(), Converter: NewConverter()}
+	bot = &ChannelBot{Telegram: nil, Config: config.FillDefaults(), Converter: NewConverter(config.Converter), shutdown: make(chan struct{}, 1)}
+
+	var poller tele.Poller = &tele.LongPoller{Timeout: time.Minute}
+	if bot.Config.Webhook != nil {
+		webhook, err := NewWebhookPoller(*bot.Config.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		webhook.OnError = func(err error) {
+			bot.alertAdmins(err.Error())
+		}
+		poller = webhook
+	}
+
 	bot.Telegram, err = tele.NewBot(tele.Settings{
 		Token:       bot.Config.Token,
 		URL:         bot.Config.Url,
-		Poller:      &tele.LongPoller{Timeout: time.Minute},
+		Poller:      poller,
 		Synchronous: config.Sync,
 		Verbose:     config.Verbose,
 		Local:       config.Local,
@@ -62,10 +90,35 @@ func New(config Config) (bot *ChannelBot, err error) {
 		return nil, err
 	}
 
+	bot.Sender = NewSender(bot.Telegram, bot.Config.RateLimits)
+
+	if bot.Config.Webhook == nil {
+		err = bot.Telegram.RemoveWebhook() // long polling doesn't work while a webhook is set
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	err = createDirectoryIfNotFound(bot.Config.TemporaryFilesDirectory)
 	if err != nil {
 		return nil, err
 	}
+	bot.TempFiles, err = NewTempFiles(path.Join(bot.Config.TemporaryFilesDirectory, TemporaryFilesSubdirectory), bot.Config.TemporaryFilesQuota)
+	if err != nil {
+		return nil, err
+	}
+	bot.sweepTemporaryFiles()
+	bot.Media, err = NewMediaJobs(path.Join(bot.Config.TemporaryFilesDirectory, MediaCacheDirectory), bot.Config.MediaWorkers, bot.Config.MediaCacheQuota)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tool := range bot.Converter.CheckTools() {
+		log.Println(tool.String())
+		if tool.Err != nil {
+			bot.alertAdmins("converter is not fully functional", tool.String())
+		}
+	}
 
 	_, err = bot.Telegram.ChatMemberOf(&tele.Chat{ID: bot.Config.ChannelId}, bot.Telegram.Me)
 	if err != nil {
@@ -93,16 +146,38 @@ func (bot *ChannelBot) Start() {
 				return err
 			}
 			if msgs[0].ReplyTo != nil {
-				orig, err := bot.Database.GetPostByMessageLink(MessageLink{MessageId: msgs[0].ReplyTo.ID, ChatId: msgs[0].Chat.ID})
+				link := MessageLink{MessageId: msgs[0].ReplyTo.ID, ChatId: msgs[0].Chat.ID}
+				if published, err := bot.Database.GetPublishedByMessageLink(link); err == nil {
+					return bot.handlePublishedMedia(msgs, published)
+				}
+				orig, err := bot.Database.GetPostByMessageLink(link)
+				if err == nil && len(msgs) == 1 && strings.TrimSpace(msgs[0].Caption) == "/replace" {
+					index := indexOfLink(orig.MessagesInChat, link)
+					var replaced TgFileInfo
+					if index >= 0 && index < len(orig.Files) {
+						replaced = orig.Files[index]
+					}
+					err = orig.ReplaceFile(index, post.Files[0], post.MessagesInChat[0])
+					if err != nil {
+						return errors.New("reply to the file that has to be replaced")
+					}
+					_, _ = bot.Telegram.Reply(msgs[0], fmt.Sprintf("File #%d is replaced.", index+1))
+					err = bot.Database.EditPost(orig)
+					if err != nil {
+						return err
+					}
+					bot.forgetMedia(orig, replaced)
+					go bot.checkDuplicates(msgs[0], orig)
+					return nil
+				}
 				if err == nil {
 					post.AsSources = post.IsDocuments()
 					msg, _ := bot.Telegram.Reply(msgs[0], "+ (comment)")
 					if msg != nil {
 						bot.MakeExpiring(time.Second*15, *msg)
 					}
-					if orig.Comment != nil {
-						post.Text = orig.Comment.Text
-					}
+					bot.fillPostDefaults(post)
+					bot.warnIfSplit(msgs[0], post)
 					return bot.Database.AddComment(orig.Id, post)
 				}
 			}
@@ -112,28 +187,20 @@ func (bot *ChannelBot) Start() {
 				bot.MakeExpiring(time.Second*15, *msg)
 			}
 			post.Text = bot.Config.DefaultPostText
-			return bot.Database.SetPost(post.Id, post)
-
-		case msgs[0].Chat.ID == bot.Config.CommentsId && msgs[0].IsForwarded() && msgs[0].Sender.ID == OfficialTelegramChannelBotId:
-			post, err := bot.Database.GetRecentlyPosted(msgs[0].OriginalMessageID)
-			if err != nil {
-				if IsErrRedisNotFound(err) {
-					return nil
-				} else {
-					return err
-				}
-			}
-			_, err = post.Comment.SendReply(bot, MessageLink{msgs[0].Chat.ID, msgs[0].ID})
-			if err != nil {
-				bot.Telegram.OnError(err, bot.Telegram.NewContext(tele.Update{Message: msgs[0]}))
+			bot.fillPostDefaults(post)
+			bot.warnIfSplit(msgs[0], post)
+			if post.Source != nil && post.Source.Hidden {
+				_, _ = bot.Telegram.Reply(msgs[0], fmt.Sprintf("The origin of the forward is hidden by '%s', add the source manually.", post.Source.Title))
 			}
-
-			err = bot.Database.RemPost(post)
+			err = bot.Database.SetPost(post.Id, post)
 			if err != nil {
-				bot.Telegram.OnError(err, bot.Telegram.NewContext(tele.Update{Message: msgs[0]}))
+				return err
 			}
+			go bot.checkDuplicates(msgs[0], post)
+			return nil
 
-			return err
+		case msgs[0].Chat.ID == bot.Config.CommentsId && msgs[0].IsForwarded() && msgs[0].Sender.ID == OfficialTelegramChannelBotId:
+			return bot.attachComments(msgs[0])
 
 		default:
 			return nil
@@ -155,8 +222,11 @@ func (bot *ChannelBot) Start() {
 		return bot.makeChannelPostWithComments(post)
 	})
 	admin.Handle("/random", func(ctx tele.Context) error {
-		post, err := bot.Database.GetRandomPostByTime(TimeIsNotSpecified)
+		post, err := bot.Database.GetRandomPostByTime(TimeIsNotSpecified, ctx.Args()...)
 		if err != nil {
+			if IsErrRedisNotFound(err) && len(ctx.Args()) > 0 {
+				return ctx.Reply(fmt.Sprintf("No posts with tags %s", strings.Join(ctx.Args(), " ")))
+			}
 			return err
 		}
 		_, _ = bot.Telegram.Reply(&tele.Message{ID: post.MessagesInChat[0].MessageId, Chat: &tele.Chat{ID: post.MessagesInChat[0].ChatId}}, "+")
@@ -179,18 +249,24 @@ func (bot *ChannelBot) Start() {
 		}
 
 		for _, post := range posts {
+			if comment := post.SourceComment(bot.Config); comment != nil {
+				post.Comments = append(post.Comments, comment)
+			}
 			messages, err := post.SendReply(bot, post.MessagesInChat[0])
 			if err != nil {
 				bot.Telegram.OnError(err, ctx)
 			} else {
 				bot.MakeExpiring(time.Minute*5, messages...)
 			}
-			if post.Comment != nil && len(messages) > 0 && messages[0].Chat != nil {
-				messages, err = post.Comment.SendReply(bot, MessageLink{messages[0].Chat.ID, messages[0].ID})
+			for _, comment := range post.Comments {
+				if len(messages) == 0 || messages[0].Chat == nil {
+					break
+				}
+				commentMessages, err := comment.SendReply(bot, MessageLink{messages[0].Chat.ID, messages[0].ID})
 				if err != nil {
 					bot.Telegram.OnError(err, ctx)
 				} else {
-					bot.MakeExpiring(time.Minute*5, messages...)
+					bot.MakeExpiring(time.Minute*5, commentMessages...)
 				}
 			}
 			time.Sleep(time.Millisecond * 100)
@@ -207,14 +283,18 @@ func (bot *ChannelBot) Start() {
 		return ctx.Send(strings.Join([]string{
 			report,
 			fmt.Sprintf("Schedule: %s\n~%.2f days covered with posts.",
-				strings.Join(bot.Config.DefaultPostTimes, " "),
+				bot.scheduleString(),
 				float64(bot.Database.Size())/float64(len(bot.Config.DefaultPostTimes))),
+			bot.Converter.Status(),
+			bot.Media.Status(),
+			bot.TempFiles.Status(),
 		}, "\n\n"))
 	})
+	admin.Handle("/failed", bot.handleFailed)
 	admin.Handle("/shutdown", func(ctx tele.Context) error {
 		if len(ctx.Args()) > 0 && strings.ToLower(ctx.Args()[0]) == "please" {
 			_ = ctx.Reply("shutting down...")
-			os.Exit(0)
+			bot.Stop()
 		} else {
 			return ctx.Reply("say 'please', be gentle")
 		}
@@ -234,18 +314,29 @@ func (bot *ChannelBot) Start() {
 			return ctx.Reply("say 'all', to be sure")
 		}
 	})
-	timeRegex := regexp.MustCompile("^([0-1][0-9]|2[0-3]):[0-5][0-9]$")
 	admin.Handle("/schedule", func(ctx tele.Context) error {
-		for _, t := range ctx.Args() {
+		times := make([]string, 0, len(ctx.Args()))
+		timeTags := map[string][]string{}
+		for _, arg := range ctx.Args() {
+			t, tags, _ := strings.Cut(arg, "#")
 			if !timeRegex.MatchString(t) {
 				return ctx.Reply(fmt.Sprintf("Time %s is invalid", t))
 			}
+			times = append(times, t)
+			if tags != "" {
+				for _, tag := range strings.Split(tags, "#") {
+					if tag = normalizeTag(tag); tag != "" {
+						timeTags[t] = append(timeTags[t], tag)
+					}
+				}
+			}
 		}
 
-		_, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Old: '%s'\nNew: '%s'",
-			strings.Join(bot.Config.DefaultPostTimes, " "), strings.Join(ctx.Args(), " ")))
+		old := bot.scheduleString()
+		bot.Config.DefaultPostTimes = times
+		bot.Config.PostTimeTags = timeTags
+		_, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Old: '%s'\nNew: '%s'", old, bot.scheduleString()))
 
-		bot.Config.DefaultPostTimes = ctx.Args()
 		err := bot.Config.Dump()
 		if err != nil {
 			return err
@@ -254,10 +345,292 @@ func (bot *ChannelBot) Start() {
 		return nil
 	})
 
+	admin.Handle("/tag", func(ctx tele.Context) error {
+		post, err := bot.getReferredPost(ctx)
+		if err != nil {
+			return err
+		}
+		old := formatTags(post.Tags)
+		post.Tags = nil
+		post.AddTags(ctx.Args()...)
+		_, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Tags '%s' --> '%s'", old, formatTags(post.Tags)))
+		return bot.Database.EditPost(post)
+	})
+
+	admin.Handle("/up", func(ctx tele.Context) error {
+		post, index, err := bot.getReferredFile(ctx)
+		if err != nil {
+			return err
+		}
+		err = post.MoveFile(index, index-1)
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		_, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("File #%d --> #%d", index+1, index))
+		err = bot.Database.EditPost(post)
+		if err != nil {
+			return err
+		}
+		bot.recordMedia(post)
+		return nil
+	})
+	admin.Handle("/down", func(ctx tele.Context) error {
+		post, index, err := bot.getReferredFile(ctx)
+		if err != nil {
+			return err
+		}
+		err = post.MoveFile(index, index+1)
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		_, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("File #%d --> #%d", index+1, index+2))
+		err = bot.Database.EditPost(post)
+		if err != nil {
+			return err
+		}
+		bot.recordMedia(post)
+		return nil
+	})
+	admin.Handle("/drop", func(ctx tele.Context) error {
+		post, index, err := bot.getReferredFile(ctx)
+		if err != nil {
+			return err
+		}
+		var dropped TgFileInfo
+		if index >= 0 && index < len(post.Files) {
+			dropped = post.Files[index]
+		}
+		err = post.DropFile(index)
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		bot.forgetMedia(post, dropped)
+		_, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("File #%d is dropped, %d left.", index+1, len(post.Files)))
+		err = bot.Database.EditPost(post)
+		if err != nil {
+			return err
+		}
+		bot.recordMedia(post)
+		return nil
+	})
+	admin.Handle("/merge", func(ctx tele.Context) error {
+		post, err := bot.getReferredPost(ctx)
+		if err != nil {
+			return err
+		}
+		target, err := bot.Database.PopPendingMerge(ctx.Chat().ID)
+		if IsErrRedisNotFound(err) || (err == nil && target.Id == post.Id) {
+			err = bot.Database.SetPendingMerge(ctx.Chat().ID, post.Id)
+			if err != nil {
+				return err
+			}
+			return ctx.Reply("Reply /merge to the post that has to be merged into this one.")
+		}
+		if err != nil {
+			return err
+		}
+
+		// neither post could be published while they are merged
+		for _, id := range []string{target.Id, post.Id} {
+			claimed, err := bot.Database.ClaimPost(id)
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				return ctx.Reply(fmt.Sprintf("Post %s is being published, it can't be merged.", id))
+			}
+			defer bot.Database.ReleasePost(id)
+		}
+		target, err = bot.Database.GetPost(target.Id)
+		if err == nil {
+			post, err = bot.Database.GetPost(post.Id)
+		}
+		if err != nil {
+			return ctx.Reply("The post is not in the queue anymore, it can't be merged.")
+		}
+
+		target.Merge(post)
+		err = bot.Database.EditPost(target)
+		if err != nil {
+			return err
+		}
+		bot.recordMedia(target)
+		merged := *post
+		merged.MessagesInChat = nil // they belong to the target now
+		err = bot.Database.RemPost(&merged)
+		if err != nil {
+			return err
+		}
+		for _, comment := range post.Comments {
+			for _, msg := range comment.MessagesInChat {
+				_ = bot.Database.AddTemporaryMessageLink(msg, target.Id)
+			}
+		}
+
+		report := fmt.Sprintf("Merged, the post has %d files and %d comments now.", len(target.Files), len(target.Comments))
+		if post.Text != "" && post.Text != target.Text {
+			report += fmt.Sprintf("\nThe text of the merged post is dropped: '%s'", post.Text)
+		}
+		if post.Source != nil && (target.Source == nil || *post.Source != *target.Source) {
+			report += fmt.Sprintf("\nThe source of the merged post is dropped: '%s'", post.Source.Title)
+		}
+		_, _ = bot.Telegram.Reply(ctx.Message(), report)
+		bot.warnIfSplit(ctx.Message(), target)
+		return nil
+	})
+	admin.Handle("/split", func(ctx tele.Context) error {
+		post, err := bot.getReferredPost(ctx)
+		if err != nil {
+			return err
+		}
+		if len(ctx.Args()) == 0 {
+			return ctx.Reply("Give the number of files to keep in the first post, e.g. /split 3")
+		}
+		index, err := strconv.Atoi(ctx.Args()[0])
+		if err != nil {
+			return ctx.Reply("Invalid number " + ctx.Args()[0])
+		}
+
+		second, err := post.Split(index)
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		second.Text = bot.Config.DefaultPostText
+		err = bot.Database.EditPost(post)
+		if err != nil {
+			return err
+		}
+		_, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Split into %d and %d files.", len(post.Files), len(second.Files)))
+		err = bot.Database.SetPost(second.Id, second)
+		if err != nil {
+			return err
+		}
+		bot.recordMedia(second)
+		return nil
+	})
+	admin.Handle("/comments", func(ctx tele.Context) error {
+		post, err := bot.getReferredPost(ctx)
+		if err != nil {
+			return err
+		}
+		if len(post.Comments) == 0 {
+			return ctx.Reply("The post has no comments.")
+		}
+		lines := make([]string, len(post.Comments))
+		for i, comment := range post.Comments {
+			lines[i] = fmt.Sprintf("%d. %s", i+1, comment.Summary())
+		}
+		return ctx.Reply(strings.Join(lines, "\n"))
+	})
+	admin.Handle("/movecomment", func(ctx tele.Context) error {
+		post, err := bot.getReferredPost(ctx)
+		if err != nil {
+			return err
+		}
+		if len(ctx.Args()) != 2 {
+			return ctx.Reply("Give the comment number and its new position, e.g. /movecomment 3 1")
+		}
+		from, errFrom := strconv.Atoi(ctx.Args()[0])
+		to, errTo := strconv.Atoi(ctx.Args()[1])
+		if errFrom != nil || errTo != nil {
+			return ctx.Reply("Invalid numbers " + strings.Join(ctx.Args(), " "))
+		}
+		err = post.MoveComment(from-1, to-1)
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		_, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Comment #%d --> #%d", from, to))
+		return bot.Database.EditPost(post)
+	})
+	admin.Handle("/delcomment", func(ctx tele.Context) error {
+		post, err := bot.getReferredPost(ctx)
+		if err != nil {
+			return err
+		}
+		index, err := bot.getReferredCommentIndex(ctx, post)
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		err = post.DropComment(index)
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		_, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Comment #%d is removed, %d left.", index+1, len(post.Comments)))
+		return bot.Database.EditPost(post)
+	})
+	admin.Handle("/docs", func(ctx tele.Context) error {
+		post, err := bot.getReferredPost(ctx)
+		if err != nil {
+			return err
+		}
+		comments := post.Comments
+		if len(ctx.Args()) > 0 {
+			index, err := bot.getReferredCommentIndex(ctx, post)
+			if err != nil || index < 0 || index >= len(post.Comments) {
+				return ctx.Reply(fmt.Sprintf("There is no such comment, there are %d comments", len(post.Comments)))
+			}
+			comments = post.Comments[index : index+1]
+		}
+
+		report := []string{}
+		for _, comment := range comments {
+			if comment.IsDocuments() && len(comment.Files) > 0 {
+				report = append(report, fmt.Sprintf("Converting sources to pictures (%t) --> (%t)", !comment.AsSources, comment.AsSources))
+				comment.AsSources = !comment.AsSources
+			}
+		}
+		if len(report) == 0 {
+			return ctx.Reply("Nothing could be changed.")
+		}
+		_, _ = bot.Telegram.Reply(ctx.Message(), strings.Join(report, "\n"))
+		return bot.Database.EditPost(post)
+	})
+	admin.Handle("/expire", func(ctx tele.Context) error {
+		post, err := bot.getReferredPost(ctx)
+		published := false
+		if IsErrRedisNotFound(err) {
+			post, err = bot.getReferredPublishedPost(ctx)
+			published = true
+		}
+		if err != nil {
+			return err
+		}
+
+		old := post.ExpirationString()
+		post.ExpiresAfter, post.DeleteAt = 0, 0
+		if len(ctx.Args()) > 0 {
+			after, at, err := parseExpiration(strings.Join(ctx.Args(), " "))
+			if err != nil {
+				return ctx.Reply(fmt.Sprintf("Expiration '%s' is invalid: %s", strings.Join(ctx.Args(), " "), err.Error()))
+			}
+			post.ExpiresAfter = after
+			if !at.IsZero() {
+				post.DeleteAt = at.Unix()
+			}
+		}
+		_, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Deletion '%s' --> '%s'", old, post.ExpirationString()))
+
+		if !published {
+			return bot.Database.EditPost(post)
+		}
+		err = bot.Database.SetPublished(post)
+		if err != nil {
+			return err
+		}
+		at := post.DeletionTime(time.Now()) // the duration is counted from now for already published posts
+		if at.IsZero() {
+			return bot.Database.RemJob(&Job{Type: JobDeletePost, PostId: post.Id})
+		}
+		return bot.Database.AddJob(&Job{Type: JobDeletePost, PostId: post.Id}, at)
+	})
+
 	admin.Handle(tele.OnText, func(ctx tele.Context) error {
 		post, err := bot.getReferredPost(ctx)
 		if err != nil {
 			if IsErrRedisNotFound(err) {
+				if published, err := bot.getReferredPublishedPost(ctx); err == nil {
+					return bot.handlePublishedText(ctx, published)
+				}
 				return ctx.Reply("hm?")
 			} else {
 				return err
@@ -265,7 +638,12 @@ func (bot *ChannelBot) Start() {
 		}
 
 		var message *tele.Message
-		if timeRegex.Match([]byte(ctx.Text())) {
+		if tags, ok := parseTags(ctx.Text()); ok {
+			old := formatTags(post.Tags)
+			post.AddTags(tags...)
+			message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Tags '%s' --> '%s'", old, formatTags(post.Tags)))
+			err = bot.Database.EditPost(post)
+		} else if timeRegex.Match([]byte(ctx.Text())) {
 			message, err = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Time '%s' --> '%s'", post.ScheduledTime, ctx.Text()))
 			post.ScheduledTime = ctx.Text()
 			err = bot.Database.EditPost(post)
@@ -276,17 +654,10 @@ func (bot *ChannelBot) Start() {
 				sources := post.Clone()
 				sources.AsSources = true
 				sources.Text = ""
+				sources.Comments = nil
 				message, _ = bot.Telegram.Reply(ctx.Message(), "Sources shall be posted.")
 				err = bot.Database.AddComment(post.Id, sources)
 			}
-		} else if ctx.Text() == "/docs" {
-			if post.Comment == nil || !post.Comment.IsDocuments() {
-				message, err = bot.Telegram.Reply(ctx.Message(), "Nothing could be changed.")
-			} else {
-				message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Converting sources to pictures (%t) --> (%t)", !post.Comment.AsSources, post.Comment.AsSources))
-				post.Comment.AsSources = !post.Comment.AsSources
-				err = bot.Database.EditPost(post)
-			}
 		} else if ctx.Text() == "/remove" {
 			err = bot.Database.RemPost(post)
 			if err == nil {
@@ -296,23 +667,61 @@ func (bot *ChannelBot) Start() {
 			message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Post text '%s' --> ''", post.Text))
 			post.Text = ""
 			err = bot.Database.EditPost(post)
+		} else if ctx.Text() == "/nosource" {
+			if post.Source == nil {
+				message, err = bot.Telegram.Reply(ctx.Message(), "Nothing could be changed.")
+			} else {
+				message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Source '%s' is removed.", post.Source.Title))
+				post.Source = nil
+				err = bot.Database.EditPost(post)
+			}
 		} else if ctx.Text() == "/nocomment" {
-			message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Comment is removed."))
-			post.Comment = nil
+			message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("%d comments are removed.", len(post.Comments)))
+			post.Comments = nil
 			err = bot.Database.EditPost(post)
 		} else if ctx.Text() == "/nocommenttext" {
-			if post.Comment == nil {
+			if len(post.Comments) == 0 {
 				message, err = bot.Telegram.Reply(ctx.Message(), "Nothing could be changed.")
 			} else {
-				message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Comment text '%s' --> ''", post.Comment.Text))
-				post.Comment.Text = ""
+				message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Texts of %d comments --> ''", len(post.Comments)))
+				for _, comment := range post.Comments {
+					comment.Text = ""
+				}
 				err = bot.Database.EditPost(post)
 			}
 		} else if ctx.Text() == "/protected" {
 			message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Post protection (%t) --> (%t)", post.Protected, !post.Protected))
 			post.Protected = !post.Protected
-			if post.Comment != nil {
-				post.Comment.Protected = post.Protected
+			for _, comment := range post.Comments {
+				comment.Protected = post.Protected
+			}
+			err = bot.Database.EditPost(post)
+		} else if ctx.Text() == "/spoiler" {
+			message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Post spoiler (%t) --> (%t)", post.Spoiler, !post.Spoiler))
+			post.Spoiler = !post.Spoiler
+			for _, comment := range post.Comments {
+				comment.Spoiler = post.Spoiler
+			}
+			err = bot.Database.EditPost(post)
+		} else if ctx.Text() == "/nowatermark" {
+			message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Post watermark disabled (%t) --> (%t)", post.NoWatermark, !post.NoWatermark))
+			post.NoWatermark = !post.NoWatermark
+			for _, comment := range post.Comments {
+				comment.NoWatermark = post.NoWatermark
+			}
+			err = bot.Database.EditPost(post)
+		} else if ctx.Text() == "/silent" {
+			message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Post silence (%t) --> (%t)", post.Silent, !post.Silent))
+			post.Silent = !post.Silent
+			for _, comment := range post.Comments {
+				comment.Silent = post.Silent
+			}
+			err = bot.Database.EditPost(post)
+		} else if ctx.Text() == "/nopreview" {
+			message, _ = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Post link preview disabled (%t) --> (%t)", post.NoPreview, !post.NoPreview))
+			post.NoPreview = !post.NoPreview
+			for _, comment := range post.Comments {
+				comment.NoPreview = post.NoPreview
 			}
 			err = bot.Database.EditPost(post)
 		} else if ctx.Text() == "/debug" {
@@ -328,15 +737,34 @@ func (bot *ChannelBot) Start() {
 			message, err = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Post text '%s' --> '%s'", post.Text, text))
 			post.Text = text
 			err = bot.Database.EditPost(post)
+			bot.warnIfSplit(ctx.Message(), post)
+		} else if strings.HasSuffix(ctx.Text(), ".c") {
+			comment := PostFromText(ctx.Message())
+			comment.Text = tgMessageToMarkdown(ctx.Text()[:len(ctx.Text())-len(".c")], ctx.Message().Entities)
+			bot.fillPostDefaults(comment)
+			comment.Protected = post.Protected
+			post.Comments = append(post.Comments, comment)
+			message, err = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Comment #%d '%s' is added", len(post.Comments), comment.Text))
+			err = bot.Database.EditPost(post)
+			bot.warnIfSplit(ctx.Message(), post)
 		} else {
 			text := tgMessageToMarkdown(ctx.Text(), ctx.Message().Entities)
-			message, err = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Comment text '%s' --> '%s'", post.Text, text))
-			if post.Comment != nil {
-				post.Comment.Text = text
-			} else {
-				post.Comment = PostFromText(ctx.Message())
+			index := post.commentIndexByMessage(MessageLink{MessageId: ctx.Message().ReplyTo.ID, ChatId: ctx.Message().ReplyTo.Chat.ID})
+			if index < 0 {
+				index = len(post.Comments) - 1
 			}
+			if index < 0 {
+				comment := PostFromText(ctx.Message())
+				comment.Text = ""
+				bot.fillPostDefaults(comment)
+				comment.Protected = post.Protected
+				post.Comments = []*Post{comment}
+				index = 0
+			}
+			message, err = bot.Telegram.Reply(ctx.Message(), fmt.Sprintf("Comment #%d text '%s' --> '%s'", index+1, post.Comments[index].Text, text))
+			post.Comments[index].Text = text
 			err = bot.Database.EditPost(post)
+			bot.warnIfSplit(ctx.Message(), post)
 		}
 		if err != nil && message != nil {
 			bot.MakeExpiring(time.Second*15, *message)
@@ -348,11 +776,27 @@ func (bot *ChannelBot) Start() {
 		return ctx.Send(bot.Config.StartMessage)
 	})
 
+	bot.reconcilePublishing()
 	go bot.startTimeBasedPostingRoutine()
+	go bot.startJobsRoutine()
 	_ = bot.Telegram.SetCommands(ChannelBotCommands)
 	go bot.Telegram.Start()
 
-	select {}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-signals:
+	case <-bot.shutdown:
+	}
+	bot.Telegram.Stop()
+}
+
+// Stop makes Start return, the poller is stopped gracefully (e.g. the webhook is deleted)
+func (bot *ChannelBot) Stop() {
+	select {
+	case bot.shutdown <- struct{}{}:
+	default:
+	}
 }
 
 func (bot *ChannelBot) getReferredPost(ctx tele.Context) (*Post, error) {
@@ -362,27 +806,64 @@ func (bot *ChannelBot) getReferredPost(ctx tele.Context) (*Post, error) {
 	return bot.Database.GetPostByMessageLink(MessageLink{MessageId: ctx.Message().ReplyTo.ID, ChatId: ctx.Message().ReplyTo.Chat.ID})
 }
 
+// getReferredFile returns the post and index of the file, which is either replied or given by its number
+func (bot *ChannelBot) getReferredFile(ctx tele.Context) (*Post, int, error) {
+	post, err := bot.getReferredPost(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(ctx.Args()) > 0 {
+		number, err := strconv.Atoi(ctx.Args()[0])
+		if err != nil {
+			return nil, 0, errors.New("invalid file number " + ctx.Args()[0])
+		}
+		return post, number - 1, nil
+	}
+	index := indexOfLink(post.MessagesInChat, MessageLink{MessageId: ctx.Message().ReplyTo.ID, ChatId: ctx.Message().ReplyTo.Chat.ID})
+	if index < 0 {
+		return nil, 0, errors.New("reply to the file or give its number")
+	}
+	return post, index, nil
+}
+
+// getReferredCommentIndex returns index of the comment, which is either given by its number or replied
+func (bot *ChannelBot) getReferredCommentIndex(ctx tele.Context, post *Post) (int, error) {
+	if len(ctx.Args()) > 0 {
+		number, err := strconv.Atoi(ctx.Args()[0])
+		if err != nil {
+			return 0, errors.New("invalid comment number " + ctx.Args()[0])
+		}
+		return number - 1, nil
+	}
+	index := post.commentIndexByMessage(MessageLink{MessageId: ctx.Message().ReplyTo.ID, ChatId: ctx.Message().ReplyTo.Chat.ID})
+	if index < 0 {
+		return 0, errors.New("reply to the comment or give its number")
+	}
+	return index, nil
+}
+
 func (bot *ChannelBot) alertAdmins(text ...string) {
 	sendAll(bot.Telegram, bot.Config.AdminList, text...)
 }
 
 func (bot *ChannelBot) startTimeBasedPostingRoutine() {
 	time.Sleep(time.Duration(60+5-time.Now().Second()) * time.Second)
-	err := bot.ifItIsTimePostRandom(time.Now().Format("15:04"), 4)
+	err := bot.ifItIsTimePostRandom(time.Now().Format("15:04"), nil, 4, nil)
 	if err != nil {
 		bot.alertAdmins("WHILE TRYING TO POST", err.Error())
 	}
 	for tick := range time.Tick(time.Minute) {
-		err = bot.ifItIsTimePostRandom(tick.Format("15:04"), 4)
+		err = bot.ifItIsTimePostRandom(tick.Format("15:04"), nil, 4, nil)
 		if err != nil {
 			bot.alertAdmins("WHILE TRYING TO POST", err.Error())
 		}
 	}
 }
 
-func (bot *ChannelBot) ifItIsTimePostRandom(t string, retries int, errs ...string) error {
+// ifItIsTimePostRandom publishes a random post scheduled for the time, posts which fail are excluded from the next retries
+func (bot *ChannelBot) ifItIsTimePostRandom(t string, tags []string, retries int, failed []string, errs ...string) error {
 	if retries >= 0 {
-		post, err := bot.Database.GetRandomPostByTime(t)
+		post, err := bot.Database.GetRandomPostByTimeExcept(t, tags, failed)
 		pointBrokenPost := func(err error) {
 			_, postErr := bot.Telegram.Reply(&tele.Message{ID: post.MessagesInChat[0].MessageId, Chat: &tele.Chat{ID: post.MessagesInChat[0].ChatId}},
 				fmt.Sprintf("an error while trying to post\n%s", err.Error()))
@@ -395,12 +876,15 @@ func (bot *ChannelBot) ifItIsTimePostRandom(t string, retries int, errs ...strin
 			if !IsErrRedisNotFound(err) {
 				return errors.New(err.Error() + " while getting random post for time " + t)
 			} else if t != TimeIsNotSpecified && contains(bot.Config.DefaultPostTimes, t) {
-				return bot.ifItIsTimePostRandom(TimeIsNotSpecified, retries, errs...)
+				return bot.ifItIsTimePostRandom(TimeIsNotSpecified, bot.Config.PostTimeTags[t], retries, failed, errs...)
 			}
 		} else {
 			err = bot.makeChannelPostWithComments(post)
 			if err != nil {
 				pointBrokenPost(err)
+				if len(post.Published) == 0 { // nothing is in the channel, so another post could be tried
+					return bot.ifItIsTimePostRandom(t, tags, retries-1, append(failed, post.Id), errs...)
+				}
 				return errors.New("an error while trying to post " + post.Id + err.Error())
 			}
 		}
@@ -413,29 +897,83 @@ func (bot *ChannelBot) ifItIsTimePostRandom(t string, retries int, errs ...strin
 	}
 }
 
-func (bot *ChannelBot) MakeExpiring(duration time.Duration, messages ...tele.Message) {
-	go func() {
-		time.Sleep(duration)
-		for _, msg := range messages {
-			err := bot.Telegram.Delete(&msg)
-			if err != nil {
-				bot.Telegram.OnError(err, bot.Telegram.NewContext(tele.Update{Message: &msg}))
-			}
+func (bot *ChannelBot) scheduleString() string {
+	slots := make([]string, len(bot.Config.DefaultPostTimes))
+	for i, t := range bot.Config.DefaultPostTimes {
+		slots[i] = t
+		for _, tag := range bot.Config.PostTimeTags[t] {
+			slots[i] += "#" + tag
 		}
-	}()
+	}
+	return strings.Join(slots, " ")
+}
+
+func (bot *ChannelBot) MakeExpiring(duration time.Duration, messages ...tele.Message) {
+	for _, msg := range messages {
+		bot.addJob(&Job{Type: JobDeleteMessage, Message: MessageLink{ChatId: msg.Chat.ID, MessageId: msg.ID}}, time.Now().Add(duration))
+	}
 }
 
 func (bot *ChannelBot) makeChannelPostWithComments(post *Post) error {
-	messages, err := post.Send(bot, &tele.Chat{ID: bot.Config.ChannelId})
+	claimed, err := bot.Database.ClaimPost(post.Id)
 	if err != nil {
 		return err
 	}
+	if !claimed {
+		return ErrPostIsBeingPublished
+	}
+	// the post could have been edited, merged or removed since it was picked, the saved version is published
+	current, err := bot.Database.GetPost(post.Id)
+	if err != nil {
+		_ = bot.Database.ReleasePost(post.Id)
+		if IsErrRedisNotFound(err) {
+			return errors.New(fmt.Sprintf("post %s is not in the queue anymore", post.Id))
+		}
+		return err
+	}
+	*post = *current
+	if post.State != "" && post.State != PostStateQueued {
+		_ = bot.Database.ReleasePost(post.Id)
+		return errors.New(fmt.Sprintf("post %s is %s already", post.Id, post.State))
+	}
+	post.State = PostStatePublishing
+	err = bot.Database.EditPost(post)
+	if err != nil {
+		_ = bot.Database.ReleasePost(post.Id)
+		return err
+	}
 
-	if post.Comment == nil {
-		return bot.Database.RemPost(post)
+	messages, err := post.Send(bot, &tele.Chat{ID: bot.Config.ChannelId})
+	post.Published = messagesToLinks(messages)
+	if err != nil && len(post.Published) == 0 {
+		post.State = PostStateQueued
+		bot.recordFailure(post, err)
+		_ = bot.Database.ReleasePost(post.Id)
+		return err
+	}
+	if err != nil {
+		bot.alertAdmins(fmt.Sprintf("post %s is published partially, %d messages are in the channel", post.Id, len(post.Published)), err.Error())
 	}
 
-	return bot.Database.AddRecentlyPosted(post.Id, messages[0].ID)
+	if comment := post.SourceComment(bot.Config); comment != nil {
+		post.Comments = append(post.Comments, comment)
+	}
+	if len(post.Comments) > 0 {
+		awaitErr := bot.awaitComments(post) // before anything else, the forward comes in a moment
+		if awaitErr != nil {
+			bot.alertAdmins("the post is published, but its comment won't be attached", awaitErr.Error())
+		}
+	}
+	post.State = PostStatePublished
+	editErr := bot.Database.EditPost(post) // from now on the post is never sent again
+	if editErr != nil {
+		bot.alertAdmins(fmt.Sprintf("post %s is in the channel, but it is not marked as published, don't post it again", post.Id), editErr.Error())
+	}
+	finishErr := bot.finishPublishing(post)
+	if err != nil {
+		return err
+	}
+	return finishErr
 }
 
 func (bot *ChannelBot) replyExpiring(to *tele.Message, text string) {
@@ -444,14 +982,20 @@ func (bot *ChannelBot) replyExpiring(to *tele.Message, text string) {
 		bot.Telegram.OnError(err, bot.Telegram.NewContext(tele.Update{Message: to}))
 		return
 	}
-	go func() {
-		time.Sleep(time.Second * 20)
-		err = bot.Telegram.Delete(message)
-		if err != nil {
-			bot.Telegram.OnError(err, bot.Telegram.NewContext(tele.Update{Message: to}))
-			return
-		}
-	}()
+	bot.MakeExpiring(time.Second*20, *message)
+}
+
+// fillPostDefaults sets post flags from the config
+func (bot *ChannelBot) fillPostDefaults(post *Post) {
+	post.Spoiler = bot.Config.MediaSpoiler
+	post.Silent = bot.Config.DisableNotification
+	post.NoPreview = bot.Config.DisableWebPagePreview
+}
+
+func (bot *ChannelBot) warnIfSplit(to *tele.Message, post *Post) {
+	if warning := post.SplitWarning(bot.Config); warning != "" {
+		_, _ = bot.Telegram.Reply(to, "Warning, the post is going to be split:\n"+warning)
+	}
 }
 
 func (bot *ChannelBot) adminOnly(next tele.HandlerFunc) tele.HandlerFunc {
@@ -2,7 +2,11 @@ package channelbot
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func createDirectoryIfNotFound(path string) error {
@@ -47,3 +51,58 @@ func containsInt(array []int64, value int64) bool {
 	}
 	return false
 }
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimLeft(strings.TrimSpace(tag), "#"))
+}
+
+// parseTags returns tags from a text consisting only of '#tag' words, ok is false if there is anything else
+func parseTags(text string) (tags []string, ok bool) {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return nil, false
+	}
+	for _, word := range words {
+		if !strings.HasPrefix(word, "#") || normalizeTag(word) == "" {
+			return nil, false
+		}
+		tags = append(tags, normalizeTag(word))
+	}
+	return tags, true
+}
+
+func formatTags(tags []string) string {
+	formatted := make([]string, len(tags))
+	for i, tag := range tags {
+		formatted[i] = "#" + tag
+	}
+	return strings.Join(formatted, " ")
+}
+
+// parseExpiration accepts either a duration like '36h', '2d12h' or a local time in ExpirationTimeLayout
+func parseExpiration(text string) (after time.Duration, at time.Time, err error) {
+	at, err = time.ParseInLocation(ExpirationTimeLayout, text, time.Local)
+	if err == nil {
+		return 0, at, nil
+	}
+
+	if days, rest, found := strings.Cut(text, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, time.Time{}, errors.New("invalid number of days in " + text)
+		}
+		after = time.Duration(n) * 24 * time.Hour
+		text = rest
+	}
+	if text != "" {
+		duration, err := time.ParseDuration(text)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		after += duration
+	}
+	if after <= 0 {
+		return 0, time.Time{}, errors.New("expiration has to be positive")
+	}
+	return after, time.Time{}, nil
+}
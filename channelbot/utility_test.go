@@ -0,0 +1,55 @@
+package channelbot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		text string
+		tags []string
+		ok   bool
+	}{
+		{"#art", []string{"art"}, true},
+		{" #Art  #sketch\n#WIP ", []string{"art", "sketch", "wip"}, true},
+		{"##art", []string{"art"}, true},
+		{"", nil, false},
+		{"#", nil, false},
+		{"#art and text", nil, false},
+		{"art", nil, false},
+	}
+	for _, test := range tests {
+		tags, ok := parseTags(test.text)
+		if ok != test.ok || !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("parseTags(%q) = %v, %t, want %v, %t", test.text, tags, ok, test.tags, test.ok)
+		}
+	}
+}
+
+func TestParseExpiration(t *testing.T) {
+	tests := []struct {
+		text  string
+		after time.Duration
+		at    time.Time
+		err   bool
+	}{
+		{text: "36h", after: time.Hour * 36},
+		{text: "90m", after: time.Minute * 90},
+		{text: "2d", after: time.Hour * 48},
+		{text: "2d12h", after: time.Hour * 60},
+		{text: "2023-05-01 10:30", at: time.Date(2023, 5, 1, 10, 30, 0, 0, time.Local)},
+		{text: "0h", err: true},
+		{text: "-1h", err: true},
+		{text: "xd", err: true},
+		{text: "2d12", err: true},
+		{text: "tomorrow", err: true},
+	}
+	for _, test := range tests {
+		after, at, err := parseExpiration(test.text)
+		if (err != nil) != test.err || after != test.after || !at.Equal(test.at) {
+			t.Errorf("parseExpiration(%q) = %s, %s, %v", test.text, after, at, err)
+		}
+	}
+}
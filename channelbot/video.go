@@ -0,0 +1,162 @@
+package channelbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	TelegramMaxUploadSize  = 50_000_000
+	TelegramThumbnailSizes = 320
+
+	VideoAudioBitrate   = 128_000
+	VideoMinimumBitrate = 200_000
+	VideoSizeMargin     = 0.95 // muxing overhead and bitrate overshoots
+)
+
+type VideoInfo struct {
+	Size        int64
+	Width       int
+	Height      int
+	Duration    float64 // seconds
+	Format      string  // e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+	VideoCodec  string
+	PixelFormat string
+	AudioCodec  string // empty if there is no audio
+}
+
+// IsPlayableInTelegram tells if telegram clients would play the video inline without converting it
+func (info *VideoInfo) IsPlayableInTelegram() bool {
+	return info.Size <= TelegramMaxUploadSize &&
+		strings.Contains(info.Format, "mp4") &&
+		info.VideoCodec == "h264" && info.PixelFormat == "yuv420p" &&
+		(info.AudioCodec == "" || info.AudioCodec == "aac")
+}
+
+// ConvertedVideo is a video ready to be uploaded, Thumbnail is empty if it could not be made
+type ConvertedVideo struct {
+	Filename  string
+	Thumbnail string
+	Info      *VideoInfo
+}
+
+func (converter *Converter) ProbeVideo(filename string) (*VideoInfo, error) {
+	output, err := exec.Command(converter.FfprobePath, "-v", "error", "-print_format", "json",
+		"-show_format", "-show_streams", filename).Output()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("while probing %s an error occured %s\n%s", filename, err.Error(), string(output)))
+	}
+
+	var probe struct {
+		Format struct {
+			Name     string `json:"format_name"`
+			Duration string `json:"duration"`
+			Size     string `json:"size"`
+		} `json:"format"`
+		Streams []struct {
+			Type        string `json:"codec_type"`
+			Codec       string `json:"codec_name"`
+			Width       int    `json:"width"`
+			Height      int    `json:"height"`
+			PixelFormat string `json:"pix_fmt"`
+		} `json:"streams"`
+	}
+	err = json.Unmarshal(output, &probe)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("while probing %s, weird info has gotten %s", filename, string(output)))
+	}
+
+	info := VideoInfo{Format: probe.Format.Name}
+	info.Size, _ = strconv.ParseInt(probe.Format.Size, 10, 64)
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	for _, stream := range probe.Streams {
+		switch {
+		case stream.Type == "video" && info.VideoCodec == "":
+			info.VideoCodec, info.PixelFormat = stream.Codec, stream.PixelFormat
+			info.Width, info.Height = stream.Width, stream.Height
+		case stream.Type == "audio" && info.AudioCodec == "":
+			info.AudioCodec = stream.Codec
+		}
+	}
+	if info.VideoCodec == "" {
+		return nil, errors.New(fmt.Sprintf("%s has no video stream", filename))
+	}
+
+	return &info, nil
+}
+
+// videoBitrate returns the video bitrate (bits/s) with which the output fits the upload limit
+func videoBitrate(info *VideoInfo) (int, error) {
+	if info.Duration <= 0 {
+		return 0, errors.New("the duration of the video is unknown")
+	}
+	bitrate := int(TelegramMaxUploadSize*8*VideoSizeMargin/info.Duration) - VideoAudioBitrate
+	if bitrate < VideoMinimumBitrate {
+		return 0, errors.New(fmt.Sprintf("the video is too long (%.0fs) to fit %d bytes", info.Duration, TelegramMaxUploadSize))
+	}
+	return bitrate, nil
+}
+
+// Video converts the video to h264/aac mp4 if telegram can't play it as is, the bitrate is capped
+// so the result fits the upload limit, a thumbnail is made either way
+func (converter *Converter) Video(filename string) (*ConvertedVideo, error) {
+	info, err := converter.ProbeVideo(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	video := &ConvertedVideo{Filename: filename, Info: info}
+	if !info.IsPlayableInTelegram() {
+		bitrate, err := videoBitrate(info)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("while converting %s an error occured %s", filename, err.Error()))
+		}
+
+		newVideo := filename + "_h264.mp4"
+		output, err := exec.Command(converter.FfmpegPath, "-i", filename,
+			"-vcodec", "libx264", "-preset", converter.Preset, "-crf", "23",
+			"-maxrate", strconv.Itoa(bitrate), "-bufsize", strconv.Itoa(bitrate*2),
+			"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2", "-pix_fmt", "yuv420p",
+			"-acodec", "aac", "-b:a", strconv.Itoa(VideoAudioBitrate),
+			"-map_metadata", "-1", "-movflags", "+faststart", "-y", newVideo).CombinedOutput()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("while converting %s an error occured %s\n%s", filename, err.Error(), string(output)))
+		}
+
+		video.Filename = newVideo
+		video.Info, err = converter.ProbeVideo(newVideo)
+		if err != nil {
+			return nil, err
+		}
+		if video.Info.Size > TelegramMaxUploadSize {
+			return nil, errors.New(fmt.Sprintf("while converting %s, the result is still too big (%d bytes)", filename, video.Info.Size))
+		}
+	}
+
+	thumbnail, err := converter.VideoThumbnail(video.Filename, video.Info)
+	if err == nil {
+		video.Thumbnail = thumbnail
+	}
+
+	return video, nil
+}
+
+// VideoThumbnail takes a frame from the first second (or the middle of shorter videos) as a jpeg telegram accepts
+func (converter *Converter) VideoThumbnail(filename string, info *VideoInfo) (string, error) {
+	thumbnail := filename + "_thumb.jpg"
+	at := math.Min(1, info.Duration/2)
+	output, err := exec.Command(converter.FfmpegPath, "-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", filename,
+		"-vframes", "1", "-vf", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", TelegramThumbnailSizes, TelegramThumbnailSizes),
+		"-q:v", "5", "-y", thumbnail).CombinedOutput()
+	if err != nil {
+		_ = os.Remove(thumbnail)
+		return "", errors.New(fmt.Sprintf("while making a thumbnail of %s an error occured %s\n%s", filename, err.Error(), string(output)))
+	}
+	return thumbnail, nil
+}
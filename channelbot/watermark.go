@@ -0,0 +1,211 @@
+package channelbot
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+const (
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+	WatermarkCenter      = "center"
+
+	DefaultWatermarkPosition = WatermarkBottomRight
+	DefaultWatermarkOpacity  = 0.5
+	DefaultWatermarkScale    = 0.2
+
+	watermarkMargin = 0.02 // of the width of the media
+)
+
+// Watermark is either a text or a png image put over photos and videos
+type Watermark struct {
+	Text     string  `json:"text,omitempty"`
+	Image    string  `json:"image,omitempty"` // path to a png, used instead of the text
+	Position string  `json:"position,omitempty"`
+	Opacity  float64 `json:"opacity,omitempty"`
+	Scale    float64 `json:"scale,omitempty"` // width of the watermark relative to the width of the media
+}
+
+func (watermark *Watermark) Enabled() bool {
+	return watermark.Text != "" || watermark.Image != ""
+}
+
+func (watermark *Watermark) fillDefaults() {
+	if watermark.Position == "" {
+		watermark.Position = DefaultWatermarkPosition
+	}
+	if watermark.Opacity <= 0 || watermark.Opacity > 1 {
+		watermark.Opacity = DefaultWatermarkOpacity
+	}
+	if watermark.Scale <= 0 || watermark.Scale > 1 {
+		watermark.Scale = DefaultWatermarkScale
+	}
+}
+
+// key changes with any setting of the watermark, so cached files with an outdated one are not used
+func (watermark *Watermark) key() string {
+	hash := fnv.New32a()
+	_, _ = fmt.Fprintf(hash, "%s|%s|%s|%f|%f", watermark.Text, watermark.Image, watermark.Position, watermark.Opacity, watermark.Scale)
+	return fmt.Sprintf("wm%08x", hash.Sum32())
+}
+
+// source returns the watermark in its original size, texts are drawn with white letters outlined with black
+func (watermark *Watermark) source() (image.Image, error) {
+	if watermark.Image != "" {
+		file, err := os.Open(watermark.Image)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return png.Decode(file)
+	}
+
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, watermark.Text).Ceil()
+	img := image.NewNRGBA(image.Rect(0, 0, width+2, face.Height+2))
+	for _, layer := range []struct {
+		dx, dy int
+		color  color.Color
+	}{{0, 1, color.Black}, {2, 1, color.Black}, {1, 0, color.Black}, {1, 2, color.Black}, {1, 1, color.White}} {
+		drawer := font.Drawer{Dst: img, Src: image.NewUniform(layer.color), Face: face,
+			Dot: fixed.P(layer.dx, face.Ascent+layer.dy)}
+		drawer.DrawString(watermark.Text)
+	}
+	return img, nil
+}
+
+// overlay returns the watermark scaled and faded for the media of the given sizes and where it has to be put
+func (watermark *Watermark) overlay(width, height int) (*image.NRGBA, image.Point, error) {
+	src, err := watermark.source()
+	if err != nil {
+		return nil, image.Point{}, err
+	}
+	bounds := src.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return nil, image.Point{}, errors.New("the watermark is empty")
+	}
+
+	w := int(float64(width) * watermark.Scale)
+	h := w * bounds.Dy() / bounds.Dx()
+	if w < 1 || h < 1 {
+		return nil, image.Point{}, errors.New(fmt.Sprintf("the media is too small (%dx%d) for the watermark", width, height))
+	}
+	scaled := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, bounds, draw.Src, nil)
+	for i := 3; i < len(scaled.Pix); i += 4 {
+		scaled.Pix[i] = uint8(float64(scaled.Pix[i]) * watermark.Opacity)
+	}
+
+	margin := int(float64(width) * watermarkMargin)
+	at := image.Point{X: margin, Y: margin}
+	switch watermark.Position {
+	case WatermarkTopRight:
+		at.X = width - w - margin
+	case WatermarkBottomLeft:
+		at.Y = height - h - margin
+	case WatermarkBottomRight:
+		at = image.Point{X: width - w - margin, Y: height - h - margin}
+	case WatermarkCenter:
+		at = image.Point{X: (width - w) / 2, Y: (height - h) / 2}
+	}
+	return scaled, at, nil
+}
+
+// WatermarkImage puts the watermark over the image and writes it back as jpeg, transparency is put on Converter.Background
+func (converter *Converter) WatermarkImage(filename string) error {
+	quality, err := strconv.Atoi(converter.JpgQuality)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(file)
+	_ = file.Close()
+	if err != nil {
+		return errors.New(fmt.Sprintf("while watermarking %s an error occured %s", filename, err.Error()))
+	}
+
+	bounds := img.Bounds()
+	overlay, at, err := converter.Watermark.overlay(bounds.Dx(), bounds.Dy())
+	if err != nil {
+		return err
+	}
+	background := converter.background
+	if background == nil {
+		background = color.White
+	}
+	result := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(result, result.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(result, result.Bounds(), img, bounds.Min, draw.Over)
+	draw.Draw(result, overlay.Bounds().Add(at), overlay, image.Point{}, draw.Over)
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(out, result, &jpeg.Options{Quality: quality})
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WatermarkVideo puts the watermark over the video, which has to be converted by Converter.Video already
+func (converter *Converter) WatermarkVideo(filename string, info *VideoInfo) (string, error) {
+	overlay, at, err := converter.Watermark.overlay(info.Width, info.Height)
+	if err != nil {
+		return "", err
+	}
+	overlayFilename := filename + "_wm.png"
+	file, err := os.Create(overlayFilename)
+	if err != nil {
+		return "", err
+	}
+	err = png.Encode(file, overlay)
+	_ = file.Close()
+	defer os.Remove(overlayFilename)
+	if err != nil {
+		return "", err
+	}
+
+	bitrate, err := videoBitrate(info)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("while watermarking %s an error occured %s", filename, err.Error()))
+	}
+	newVideo := filename + "_wm.mp4"
+	output, err := exec.Command(converter.FfmpegPath, "-i", filename, "-i", overlayFilename,
+		"-filter_complex", fmt.Sprintf("[0:v][1:v]overlay=%d:%d", at.X, at.Y),
+		"-vcodec", "libx264", "-preset", converter.Preset, "-crf", "23",
+		"-maxrate", strconv.Itoa(bitrate), "-bufsize", strconv.Itoa(bitrate*2), "-pix_fmt", "yuv420p",
+		"-acodec", "copy", "-map_metadata", "-1", "-movflags", "+faststart", "-y", newVideo).CombinedOutput()
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("while watermarking %s an error occured %s\n%s", filename, err.Error(), string(output)))
+	}
+	// the bitrate is capped, but re-encoding could still overshoot, e.g. with a short video or a busy overlay
+	stat, err := os.Stat(newVideo)
+	if err != nil {
+		return "", err
+	}
+	if stat.Size() > TelegramMaxUploadSize {
+		_ = os.Remove(newVideo)
+		return "", errors.New(fmt.Sprintf("while watermarking %s, the result is too big (%d bytes)", filename, stat.Size()))
+	}
+	return newVideo, nil
+}
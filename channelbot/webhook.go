@@ -0,0 +1,135 @@
+package channelbot
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	tele "github.com/dontsellfish/telebot_local"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultWebhookPath       = "/"
+	WebhookSecretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+)
+
+// WebhookConfig turns the webhook mode on instead of long polling, the listener is plain http unless cert and key
+// are given, so it is meant to be behind a reverse proxy, which terminates TLS and forwards PublicURL to Listen + Path
+type WebhookConfig struct {
+	Listen             string `json:"listen"`                 // e.g. "127.0.0.1:8080"
+	Path               string `json:"path,omitempty"`         // default "/"
+	PublicURL          string `json:"public-url"`             // the url telegram sends updates to
+	SecretToken        string `json:"secret-token,omitempty"` // random for every start if empty
+	CertFile           string `json:"cert-file,omitempty"`
+	KeyFile            string `json:"key-file,omitempty"`
+	UploadCert         bool   `json:"upload-cert,omitempty"` // for self-signed certificates
+	MaxConnections     int    `json:"max-connections,omitempty"`
+	DropPendingUpdates bool   `json:"drop-pending-updates,omitempty"`
+}
+
+// WebhookPoller is tele.Poller, which calls setWebhook on start and deleteWebhook on stop
+type WebhookPoller struct {
+	Config  WebhookConfig
+	OnError func(err error)
+}
+
+func NewWebhookPoller(cfg WebhookConfig) (*WebhookPoller, error) {
+	if cfg.Listen == "" || cfg.PublicURL == "" {
+		return nil, errors.New("webhook: listen and public-url have to be set")
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("webhook: both cert-file and key-file have to be set for TLS")
+	}
+	if cfg.Path == "" {
+		cfg.Path = DefaultWebhookPath
+	}
+	if cfg.SecretToken == "" {
+		buffer := make([]byte, 32)
+		_, err := rand.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		cfg.SecretToken = hex.EncodeToString(buffer)
+	}
+	return &WebhookPoller{Config: cfg}, nil
+}
+
+func (poller *WebhookPoller) Poll(bot *tele.Bot, dest chan tele.Update, stop chan struct{}) {
+	webhook := &tele.Webhook{
+		MaxConnections: poller.Config.MaxConnections,
+		DropUpdates:    poller.Config.DropPendingUpdates,
+		SecretToken:    poller.Config.SecretToken,
+		Endpoint:       &tele.WebhookEndpoint{PublicURL: poller.Config.PublicURL},
+	}
+	if poller.Config.UploadCert {
+		webhook.Endpoint.Cert = poller.Config.CertFile
+	}
+	err := bot.SetWebhook(webhook)
+	if err != nil {
+		poller.report("setWebhook failed", err)
+		<-stop
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(poller.Config.Path, poller.handler(dest, stop))
+	server := &http.Server{Addr: poller.Config.Listen, Handler: mux}
+	go func() {
+		var err error
+		if poller.Config.CertFile != "" {
+			err = server.ListenAndServeTLS(poller.Config.CertFile, poller.Config.KeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			poller.report("listener failed", err)
+		}
+	}()
+
+	<-stop
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	_ = server.Shutdown(ctx)
+	// telebot cancels its requests once it is stopped, so the raw client is used
+	_, err = rawRequest(bot, "deleteWebhook", map[string]string{}, nil)
+	if err != nil {
+		poller.report("deleteWebhook failed", err)
+	}
+}
+
+func (poller *WebhookPoller) report(what string, err error) {
+	log.Printf("webhook: %s: %s", what, err.Error())
+	if poller.OnError != nil {
+		poller.OnError(errors.New("webhook: " + what + ": " + err.Error()))
+	}
+}
+
+func (poller *WebhookPoller) handler(dest chan tele.Update, stop chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.Header.Get(WebhookSecretTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(poller.Config.SecretToken)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var update tele.Update
+		err := json.NewDecoder(r.Body).Decode(&update)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		select {
+		case dest <- update:
+		case <-stop:
+			w.WriteHeader(http.StatusServiceUnavailable) // telegram will send it again later
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package channelbot
+
+import (
+	tele "github.com/dontsellfish/telebot_local"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestWebhookPoller(t *testing.T) {
+	api := newFakeBotApi(t)
+	address := freeAddress(t)
+	poller, err := NewWebhookPoller(WebhookConfig{Listen: address, Path: "/hook", PublicURL: "https://example.com/hook", SecretToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := make(chan tele.Update, 3) // so a wrongly accepted update does not block the test
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		poller.Poll(api.Bot, dest, stop)
+		close(done)
+	}()
+
+	post := func(token string) int {
+		request, _ := http.NewRequest(http.MethodPost, "http://"+address+"/hook", strings.NewReader(`{"update_id":7}`))
+		if token != "" {
+			request.Header.Set(WebhookSecretTokenHeader, token)
+		}
+		for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond * 10) {
+			response, err := http.DefaultClient.Do(request)
+			if err == nil {
+				response.Body.Close()
+				return response.StatusCode
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if code := post(""); code != http.StatusUnauthorized {
+		t.Errorf("an update without the secret is answered with %d", code)
+	}
+	if code := post("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("an update with a wrong secret is answered with %d", code)
+	}
+	if code := post("secret"); code != http.StatusOK {
+		t.Errorf("an update with the secret is answered with %d", code)
+	}
+	select {
+	case update := <-dest:
+		if update.ID != 7 {
+			t.Errorf("update %d is delivered, want 7", update.ID)
+		}
+	case <-time.After(time.Second):
+		t.Error("the update is not delivered")
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 15):
+		t.Fatal("the poller is not stopped")
+	}
+
+	calls := api.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("%d calls are made, want 2: %+v", len(calls), calls)
+	}
+	if calls[0].Method != "setWebhook" || !strings.Contains(calls[0].Params["body"], `"secret_token":"secret"`) ||
+		!strings.Contains(calls[0].Params["body"], "https://example.com/hook") {
+		t.Errorf("the webhook is set as %+v", calls[0])
+	}
+	if calls[1].Method != "deleteWebhook" {
+		t.Errorf("the webhook is not deleted on stop, the last call is %+v", calls[1])
+	}
+}
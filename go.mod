@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/dontsellfish/telebot_local v0.0.0-20230111144352-dc635a67c3a2
 	github.com/go-redis/redis/v8 v8.11.5
+	golang.org/x/image v0.10.0
 )
 
 require (